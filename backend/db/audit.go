@@ -0,0 +1,248 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+	"wira-dashboard/models"
+)
+
+// auditGenesisHash is the previous hash of the first audit log entry
+var auditGenesisHash = fmt.Sprintf("%064d", 0)
+
+// auditHashInput is what an entry's hash covers, in a fixed field order. The
+// actor's username, IP address and user agent live in audit_log_actors and
+// are deleted along with the user, so the entry only covers a salted hash of
+// them (ActorHash, empty when the entry has no actor details).
+type auditHashInput struct {
+	PrevHash   string          `json:"prev_hash"`
+	CreatedAt  string          `json:"created_at"`
+	ActorID    *int            `json:"actor_id"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Metadata   json.RawMessage `json:"metadata"`
+	ActorHash  string          `json:"actor_hash,omitempty"`
+}
+
+// auditActorHashInput is what an audit_log_actors row's hash covers. The
+// random salt is stored in the row, so once the row is deleted the hash left
+// in audit_log cannot be used to guess who the actor was.
+type auditActorHashInput struct {
+	Salt          string `json:"salt"`
+	ActorID       *int   `json:"actor_id"`
+	ActorUsername string `json:"actor_username"`
+	IPAddress     string `json:"ip_address"`
+	UserAgent     string `json:"user_agent"`
+}
+
+// auditActorHash computes the hash of an entry's actor details
+func auditActorHash(e *models.AuditEntry, salt string) (string, error) {
+	input, err := json.Marshal(auditActorHashInput{
+		Salt:          salt,
+		ActorID:       e.ActorID,
+		ActorUsername: e.ActorUsername,
+		IPAddress:     e.IPAddress,
+		UserAgent:     e.UserAgent,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(input)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// canonicalJSON re-encodes JSON with sorted object keys and no insignificant
+// whitespace, so metadata hashes the same after a round trip through JSONB
+func canonicalJSON(data []byte) (json.RawMessage, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return json.RawMessage("{}"), nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// auditHash computes the chained hash of an entry
+func auditHash(e *models.AuditEntry, metadata json.RawMessage) (string, error) {
+	input, err := json.Marshal(auditHashInput{
+		PrevHash:   e.PrevHash,
+		CreatedAt:  e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		ActorID:    e.ActorID,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetID:   e.TargetID,
+		Metadata:   metadata,
+		ActorHash:  e.ActorHash,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(input)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AppendAudit adds an entry to the audit log, chaining its hash to the
+// previous entry. Appends are serialized with an advisory lock so the chain
+// has no forks. The actor's username, IP address and user agent go to
+// audit_log_actors, and the entry keeps a salted hash of them.
+func AppendAudit(db *sql.DB, e models.AuditEntry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := appendAudit(tx, e); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// appendAudit adds an entry to the audit log within tx, so callers can make
+// the entry part of the change it records
+func appendAudit(tx *sql.Tx, e models.AuditEntry) error {
+	if e.Metadata == nil {
+		e.Metadata = map[string]interface{}{}
+	}
+	raw, err := json.Marshal(e.Metadata)
+	if err != nil {
+		return err
+	}
+	metadata, err := canonicalJSON(raw)
+	if err != nil {
+		return err
+	}
+	// Postgres keeps microseconds
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('audit_log'))"); err != nil {
+		return err
+	}
+	err = tx.QueryRow("SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&e.PrevHash)
+	if err == sql.ErrNoRows {
+		e.PrevHash = auditGenesisHash
+	} else if err != nil {
+		return err
+	}
+
+	hasActor := e.ActorUsername != "" || e.IPAddress != "" || e.UserAgent != ""
+	var salt string
+	var actorHash *string
+	if hasActor {
+		saltBytes := make([]byte, 16)
+		if _, err := rand.Read(saltBytes); err != nil {
+			return err
+		}
+		salt = hex.EncodeToString(saltBytes)
+		if e.ActorHash, err = auditActorHash(&e, salt); err != nil {
+			return err
+		}
+		actorHash = &e.ActorHash
+	}
+
+	e.Hash, err = auditHash(&e, metadata)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO audit_log (created_at, actor_id, action, target_type, target_id, metadata, prev_hash, hash, actor_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id`,
+		e.CreatedAt, e.ActorID, e.Action, e.TargetType, e.TargetID,
+		string(metadata), e.PrevHash, e.Hash, actorHash).Scan(&e.ID)
+	if err != nil {
+		return err
+	}
+
+	if hasActor {
+		_, err = tx.Exec(`
+			INSERT INTO audit_log_actors (audit_id, actor_id, actor_username, ip_address, user_agent, salt)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			e.ID, e.ActorID, e.ActorUsername, e.IPAddress, e.UserAgent, salt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditVerification is the result of checking the audit log hash chain
+type AuditVerification struct {
+	Entries  int    `json:"entries"`
+	Valid    bool   `json:"valid"`
+	BrokenAt int64  `json:"broken_at,omitempty"` // ID of the first entry that does not match
+	Reason   string `json:"reason,omitempty"`
+	LastHash string `json:"last_hash"` // keep a copy elsewhere to detect truncation
+}
+
+// VerifyAuditLog recomputes every hash in the audit log and checks that each
+// entry links to the one before it and that its actor details, unless they
+// have been purged, match the hash the entry keeps of them
+func VerifyAuditLog(db *sql.DB) (*AuditVerification, error) {
+	rows, err := db.Query(`
+		SELECT l.id, l.created_at, l.actor_id, l.action, l.target_type, l.target_id, l.metadata::text,
+			l.prev_hash, l.hash, COALESCE(l.actor_hash, ''),
+			a.audit_id IS NOT NULL, a.actor_id, COALESCE(a.actor_username, ''),
+			COALESCE(a.ip_address, ''), COALESCE(a.user_agent, ''), COALESCE(a.salt, '')
+		FROM audit_log l
+		LEFT JOIN audit_log_actors a ON a.audit_id = l.id
+		ORDER BY l.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &AuditVerification{Valid: true, LastHash: auditGenesisHash}
+	for rows.Next() {
+		var e models.AuditEntry
+		var metadata, salt string
+		var hasActor bool
+		var actor models.AuditEntry
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.Action, &e.TargetType,
+			&e.TargetID, &metadata, &e.PrevHash, &e.Hash, &e.ActorHash,
+			&hasActor, &actor.ActorID, &actor.ActorUsername, &actor.IPAddress, &actor.UserAgent, &salt); err != nil {
+			return nil, err
+		}
+		result.Entries++
+
+		if e.PrevHash != result.LastHash {
+			result.Valid, result.BrokenAt, result.Reason = false, e.ID, "previous hash does not match the preceding entry"
+			return result, nil
+		}
+		canonical, err := canonicalJSON([]byte(metadata))
+		if err != nil {
+			return nil, err
+		}
+		hash, err := auditHash(&e, canonical)
+		if err != nil {
+			return nil, err
+		}
+		if hash != e.Hash {
+			result.Valid, result.BrokenAt, result.Reason = false, e.ID, "entry contents do not match its hash"
+			return result, nil
+		}
+		if hasActor {
+			actorHash, err := auditActorHash(&actor, salt)
+			if err != nil {
+				return nil, err
+			}
+			if e.ActorHash == "" || actorHash != e.ActorHash {
+				result.Valid, result.BrokenAt, result.Reason = false, e.ID, "actor details do not match the entry's actor hash"
+				return result, nil
+			}
+		}
+		result.LastHash = e.Hash
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+	"wira-dashboard/models"
+	"wira-dashboard/utils"
+)
+
+// PurgeExpiredTokens deletes expired refresh tokens, access token records,
+// denylist entries, 2FA challenges, WebAuthn ceremonies, password reset and
+// email verification tokens and game link codes, along with failed login
+// attempts older than a day and security events older than 90 days
+func PurgeExpiredTokens(db *sql.DB) error {
+	queries := []string{
+		`DELETE FROM refresh_tokens WHERE expires_at < NOW()`,
+		`DELETE FROM access_tokens WHERE expires_at < NOW()`,
+		`DELETE FROM revoked_tokens WHERE expires_at < NOW()`,
+		`DELETE FROM login_challenges WHERE expires_at < NOW()`,
+		`DELETE FROM webauthn_sessions WHERE expires_at < NOW()`,
+		`DELETE FROM password_reset_tokens WHERE expires_at < NOW()`,
+		`DELETE FROM email_verification_tokens WHERE expires_at < NOW()`,
+		`DELETE FROM game_link_codes WHERE expires_at < NOW()`,
+		`DELETE FROM failed_attempts WHERE attempt_time < NOW() - INTERVAL '1 day'`,
+		`DELETE FROM security_events WHERE created_at < NOW() - INTERVAL '90 days'`,
+	}
+
+	for _, query := range queries {
+		result, err := db.Exec(query)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			log.Printf("Token cleanup: %s removed %d rows", query, n)
+		}
+	}
+	return nil
+}
+
+// PurgeDeletedUsers permanently deletes the users whose account deletion grace
+// period has passed. Their sessions, activities, 2FA settings and game
+// account links go with them through ON DELETE CASCADE, and their avatar is
+// removed from blobs. Failed login attempts and security events for their
+// username are deleted, as are the username, IP address and user agent behind
+// their audit log entries, so the audit log only refers to them by ID. Each
+// deletion leaves an audit record with the user's ID but no username or email.
+// Each user is deleted in its own transaction; a user whose deletion fails is
+// left in place and retried on the next run.
+func PurgeDeletedUsers(db *sql.DB, blobs utils.BlobStore) error {
+	rows, err := db.Query(`SELECT id FROM users WHERE deletion_scheduled_for <= NOW()`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	deleted := 0
+	for _, id := range ids {
+		avatarKey, ok, err := purgeDeletedUser(db, id)
+		if err != nil {
+			log.Printf("Error deleting user %d: %v", id, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		deleted++
+		if avatarKey != nil {
+			if err := blobs.Delete(*avatarKey); err != nil {
+				log.Printf("Error deleting avatar of deleted user %d: %v", id, err)
+			}
+		}
+	}
+	if deleted > 0 {
+		log.Printf("Account cleanup: deleted %d users", deleted)
+	}
+	return nil
+}
+
+// purgeDeletedUser deletes one user whose grace period has passed together
+// with what outlives their row: failed login attempts and security events
+// recorded under their username, and the audit_log_actors rows for actions
+// they performed or that were performed on their account without a signed-in
+// actor, such as a password reset. It reports false if the user is gone or
+// has cancelled the deletion since they were listed.
+func purgeDeletedUser(db *sql.DB, userID int) (avatarKey *string, ok bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	var username string
+	var requestedAt time.Time
+	err = tx.QueryRow(`
+		DELETE FROM users
+		WHERE id = $1 AND deletion_scheduled_for <= NOW()
+		RETURNING username, deletion_requested_at, avatar_key`,
+		userID).Scan(&username, &requestedAt, &avatarKey)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`DELETE FROM failed_attempts WHERE username = $1`, []interface{}{username}},
+		{`DELETE FROM security_events WHERE username = $1`, []interface{}{username}},
+		{`DELETE FROM audit_log_actors
+			WHERE actor_id = $1
+				OR audit_id IN (
+					SELECT id FROM audit_log
+					WHERE actor_id IS NULL AND target_type = 'user' AND target_id = $2
+				)`, []interface{}{userID, strconv.Itoa(userID)}},
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(q.query, q.args...); err != nil {
+			return nil, false, err
+		}
+	}
+
+	err = appendAudit(tx, models.AuditEntry{
+		Action:     "account_deleted",
+		TargetType: "user",
+		TargetID:   strconv.Itoa(userID),
+		Metadata: map[string]interface{}{
+			"requested_at": requestedAt.UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return avatarKey, true, nil
+}
+
+// StartTokenCleanup runs PurgeExpiredTokens and PurgeDeletedUsers every
+// interval in the background.
+// The returned function stops the job and waits for it to exit.
+func StartTokenCleanup(db *sql.DB, interval time.Duration, blobs utils.BlobStore) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := PurgeExpiredTokens(db); err != nil {
+					log.Printf("Error purging expired tokens: %v", err)
+				}
+				if err := PurgeDeletedUsers(db, blobs); err != nil {
+					log.Printf("Error purging deleted users: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
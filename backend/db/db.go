@@ -57,11 +57,59 @@ func createAuthTables(db *sql.DB) error {
 			username VARCHAR(255) UNIQUE NOT NULL,
 			email VARCHAR(255) UNIQUE NOT NULL,
 			password_hash VARCHAR(255) NOT NULL,
-			two_factor_secret VARCHAR(32),
+			two_factor_secret TEXT,
 			two_factor_enabled BOOLEAN DEFAULT false,
 			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 		)`,
+		// Start (Unix seconds) of the last accepted TOTP time-step
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS two_factor_last_used BIGINT`,
+		`ALTER TABLE users ALTER COLUMN two_factor_secret TYPE TEXT`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS two_factor_pending_secret TEXT`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS two_factor_pending_expires_at TIMESTAMP WITH TIME ZONE`,
+		`CREATE TABLE IF NOT EXISTS roles (
+			name VARCHAR(20) PRIMARY KEY,
+			description VARCHAR(255) NOT NULL DEFAULT '',
+			rank INTEGER NOT NULL
+		)`,
+		`INSERT INTO roles (name, description, rank) VALUES
+			('player', 'Regular dashboard user', 0),
+			('moderator', 'Can moderate players and scores', 1),
+			('admin', 'Full administrative access', 2)
+		ON CONFLICT (name) DO NOTHING`,
+		`CREATE TABLE IF NOT EXISTS role_permissions (
+			role VARCHAR(20) REFERENCES roles(name) ON DELETE CASCADE,
+			permission VARCHAR(50) NOT NULL,
+			PRIMARY KEY (role, permission)
+		)`,
+		`INSERT INTO role_permissions (role, permission) VALUES
+			('moderator', 'lockouts:manage'),
+			('admin', 'lockouts:manage'),
+			('admin', 'roles:manage'),
+			('moderator', 'scores:void'),
+			('admin', 'scores:void'),
+			('moderator', 'accounts:ban'),
+			('admin', 'accounts:ban'),
+			('moderator', 'users:read'),
+			('admin', 'users:read'),
+			('admin', 'users:manage'),
+			('admin', 'audit:read'),
+			('moderator', 'security:read'),
+			('admin', 'security:read')
+		ON CONFLICT DO NOTHING`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'player' REFERENCES roles(name)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_reason TEXT`,
+		// Set while a user-requested account deletion waits out its grace
+		// period; db.PurgeDeletedUsers removes the user after deletion_scheduled_for
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_requested_at TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_for TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name VARCHAR(50)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS bio TEXT`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_key VARCHAR(255)`,
+		// Accounts created before verification existed count as verified;
+		// Register inserts new users as unverified
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT true`,
 		`CREATE TABLE IF NOT EXISTS refresh_tokens (
 			id SERIAL PRIMARY KEY,
 			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
@@ -69,12 +117,170 @@ func createAuthTables(db *sql.DB) error {
 			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
 			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS user_agent TEXT`,
+		`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS ip_address VARCHAR(45)`,
+		`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMP WITH TIME ZONE`,
+		`CREATE TABLE IF NOT EXISTS access_tokens (
+			jti VARCHAR(64) PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			session_id INTEGER REFERENCES refresh_tokens(id) ON DELETE SET NULL,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`ALTER TABLE access_tokens ADD COLUMN IF NOT EXISTS reauthenticated_at TIMESTAMP WITH TIME ZONE`,
+		`CREATE INDEX IF NOT EXISTS idx_access_tokens_user_id ON access_tokens(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_access_tokens_session_id ON access_tokens(session_id)`,
+		`CREATE TABLE IF NOT EXISTS revoked_tokens (
+			jti VARCHAR(64) PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			revoked_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS login_challenges (
+			jti VARCHAR(64) PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			used_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS two_factor_recovery_codes (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			code_hash VARCHAR(64) NOT NULL,
+			used_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_two_factor_recovery_codes_user_id ON two_factor_recovery_codes(user_id)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS webauthn_user_handle BYTEA UNIQUE`,
+		`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			credential_id BYTEA UNIQUE NOT NULL,
+			public_key BYTEA NOT NULL,
+			attestation_type VARCHAR(32) NOT NULL DEFAULT '',
+			transports VARCHAR(255) NOT NULL DEFAULT '',
+			aaguid BYTEA,
+			sign_count BIGINT NOT NULL DEFAULT 0,
+			backup_eligible BOOLEAN NOT NULL DEFAULT false,
+			backup_state BOOLEAN NOT NULL DEFAULT false,
+			name VARCHAR(100) NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP WITH TIME ZONE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_sessions (
+			id VARCHAR(64) PRIMARY KEY,
+			purpose VARCHAR(20) NOT NULL,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			challenge_jti VARCHAR(64),
+			data TEXT NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS password_reset_tokens (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			used_at TIMESTAMP WITH TIME ZONE,
+			ip_address VARCHAR(45),
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens(user_id)`,
+		`CREATE TABLE IF NOT EXISTS email_verification_tokens (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			email VARCHAR(255) NOT NULL,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_email_verification_tokens_user_id ON email_verification_tokens(user_id)`,
+		// "verify" confirms the current address, "change" confirms a new one
+		`ALTER TABLE email_verification_tokens ADD COLUMN IF NOT EXISTS purpose VARCHAR(20) NOT NULL DEFAULT 'verify'`,
+		`CREATE TABLE IF NOT EXISTS rate_limits (
+			key VARCHAR(255) PRIMARY KEY,
+			tat BIGINT NOT NULL,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`,
 		`CREATE TABLE IF NOT EXISTS failed_attempts (
 			id SERIAL PRIMARY KEY,
 			username VARCHAR(255) NOT NULL,
 			ip_address VARCHAR(45) NOT NULL,
 			attempt_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`ALTER TABLE failed_attempts ADD COLUMN IF NOT EXISTS attempt_type VARCHAR(20) NOT NULL DEFAULT 'password'`,
+		`CREATE INDEX IF NOT EXISTS idx_failed_attempts_username ON failed_attempts(username, attempt_time)`,
+		`CREATE INDEX IF NOT EXISTS idx_failed_attempts_ip_address ON failed_attempts(ip_address, attempt_time)`,
+		// Security events that belong to no user, such as logins with an
+		// unknown username; per-user events go to user_activities
+		`CREATE TABLE IF NOT EXISTS security_events (
+			id BIGSERIAL PRIMARY KEY,
+			event_type VARCHAR(50) NOT NULL,
+			username VARCHAR(255) NOT NULL DEFAULT '',
+			ip_address VARCHAR(45) NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_security_events_ip_address ON security_events(ip_address, event_type, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_security_events_username ON security_events(username, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_security_events_created_at ON security_events(created_at)`,
+		// Append-only audit log. Each row's hash covers its contents and the
+		// previous row's hash; the trigger rejects changes to existing rows.
+		// actor_id has no foreign key so entries outlive deleted users.
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			actor_id INTEGER,
+			action VARCHAR(50) NOT NULL,
+			target_type VARCHAR(30) NOT NULL DEFAULT '',
+			target_id VARCHAR(64) NOT NULL DEFAULT '',
+			metadata JSONB NOT NULL DEFAULT '{}',
+			prev_hash CHAR(64) NOT NULL,
+			hash CHAR(64) UNIQUE NOT NULL,
+			actor_hash CHAR(64)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_actor_id ON audit_log(actor_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target_type, target_id)`,
+		// Who performed an audited action: username, IP address and user
+		// agent. Kept outside the hash chain so PurgeDeletedUsers can drop
+		// them, leaving only the user's ID in audit_log; audit_log.actor_hash
+		// covers them with the row's salt. Rows can be deleted but not changed.
+		`CREATE TABLE IF NOT EXISTS audit_log_actors (
+			audit_id BIGINT PRIMARY KEY REFERENCES audit_log(id),
+			actor_id INTEGER,
+			actor_username VARCHAR(255) NOT NULL DEFAULT '',
+			ip_address VARCHAR(45) NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			salt CHAR(32) NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_actors_actor_id ON audit_log_actors(actor_id)`,
+		`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log`,
+		`CREATE TRIGGER audit_log_append_only
+			BEFORE UPDATE OR DELETE ON audit_log
+			FOR EACH ROW EXECUTE FUNCTION audit_log_append_only()`,
+		`DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log`,
+		`CREATE TRIGGER audit_log_no_truncate
+			BEFORE TRUNCATE ON audit_log
+			FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()`,
+		`CREATE OR REPLACE FUNCTION audit_log_actors_delete_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_log_actors rows can only be deleted';
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS audit_log_actors_delete_only ON audit_log_actors`,
+		`CREATE TRIGGER audit_log_actors_delete_only
+			BEFORE UPDATE ON audit_log_actors
+			FOR EACH ROW EXECUTE FUNCTION audit_log_actors_delete_only()`,
+		`DROP TRIGGER IF EXISTS audit_log_actors_no_truncate ON audit_log_actors`,
+		`CREATE TRIGGER audit_log_actors_no_truncate
+			BEFORE TRUNCATE ON audit_log_actors
+			FOR EACH STATEMENT EXECUTE FUNCTION audit_log_actors_delete_only()`,
 		`CREATE TABLE IF NOT EXISTS user_activities (
 			id SERIAL PRIMARY KEY,
 			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
@@ -83,6 +289,8 @@ func createAuthTables(db *sql.DB) error {
 			ip_address VARCHAR(45),
 			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`ALTER TABLE user_activities ADD COLUMN IF NOT EXISTS user_agent TEXT`,
+		`CREATE INDEX IF NOT EXISTS idx_user_activities_user_created ON user_activities(user_id, created_at DESC, id DESC)`,
 	}
 
 	for _, query := range queries {
@@ -116,6 +324,38 @@ func createRankingTables(db *sql.DB) error {
 			reward_score INTEGER NOT NULL DEFAULT 0,
 			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 		)`,
+		// Moderation: voided scores and banned or suspended accounts are
+		// left out of rankings and stats
+		`ALTER TABLE scores ADD COLUMN IF NOT EXISTS voided_at TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE scores ADD COLUMN IF NOT EXISTS void_reason TEXT`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS banned_at TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS banned_until TIMESTAMP WITH TIME ZONE`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS ban_reason TEXT`,
+		`CREATE TABLE IF NOT EXISTS moderation_actions (
+			id SERIAL PRIMARY KEY,
+			actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			action VARCHAR(30) NOT NULL,
+			acc_id INTEGER REFERENCES accounts(acc_id) ON DELETE SET NULL,
+			score_id INTEGER REFERENCES scores(score_id) ON DELETE SET NULL,
+			reason TEXT NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_moderation_actions_acc_id ON moderation_actions(acc_id)`,
+		// Links between dashboard users and game accounts
+		`CREATE TABLE IF NOT EXISTS user_game_accounts (
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			acc_id INTEGER NOT NULL UNIQUE REFERENCES accounts(acc_id) ON DELETE CASCADE,
+			linked_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, acc_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS game_link_codes (
+			code_hash VARCHAR(64) PRIMARY KEY,
+			acc_id INTEGER NOT NULL REFERENCES accounts(acc_id) ON DELETE CASCADE,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_game_link_codes_acc_id ON game_link_codes(acc_id)`,
 	}
 
 	for _, query := range queries {
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"wira-dashboard/utils"
+)
+
+// EncryptTOTPSecrets encrypts plaintext TOTP secrets and re-encrypts secrets
+// that use a key other than the current one, for both the active and the
+// pending secret columns
+func EncryptTOTPSecrets(db *sql.DB, box *utils.SecretBox) error {
+	for _, column := range []string{"two_factor_secret", "two_factor_pending_secret"} {
+		if err := encryptSecretColumn(db, box, column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptSecretColumn (re-)encrypts the TOTP secrets stored in a users column
+func encryptSecretColumn(db *sql.DB, box *utils.SecretBox, column string) error {
+	rows, err := db.Query(fmt.Sprintf("SELECT id, %s FROM users WHERE %s IS NOT NULL", column, column))
+	if err != nil {
+		return err
+	}
+
+	type secretRow struct {
+		userID int
+		secret string
+	}
+	var pending []secretRow
+	for rows.Next() {
+		var row secretRow
+		if err := rows.Scan(&row.userID, &row.secret); err != nil {
+			rows.Close()
+			return err
+		}
+		if box.NeedsReencrypt(row.secret) {
+			pending = append(pending, row)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, row := range pending {
+		aad := utils.TOTPSecretAAD(row.userID)
+		plaintext, err := box.Decrypt(row.secret, aad)
+		if err != nil {
+			return fmt.Errorf("error decrypting TOTP secret of user %d: %v", row.userID, err)
+		}
+		encrypted, err := box.Encrypt(plaintext, aad)
+		if err != nil {
+			return err
+		}
+		// Only update if the row has not changed in the meantime
+		_, err = db.Exec(fmt.Sprintf(`
+			UPDATE users SET %s = $1
+			WHERE id = $2 AND %s = $3`, column, column),
+			encrypted, row.userID, row.secret)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(pending) > 0 {
+		log.Printf("Encrypted %d TOTP secrets in users.%s", len(pending), column)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// PromoteAdmins gives the admin role to the users listed in the
+// comma-separated usernames (ADMIN_USERNAMES), so a fresh deployment has an
+// administrator. Users not listed keep their role.
+func PromoteAdmins(db *sql.DB, usernames string) error {
+	var names []string
+	for _, name := range strings.Split(usernames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	result, err := db.Exec(`
+		UPDATE users SET role = 'admin', updated_at = CURRENT_TIMESTAMP
+		WHERE username = ANY($1) AND role <> 'admin'`, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Promoted %d users to admin", n)
+	}
+	return nil
+}
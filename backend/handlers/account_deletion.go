@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accountDeletionGracePeriod is how long a deleted account can still be
+// restored by signing in, read from ACCOUNT_DELETION_GRACE_PERIOD
+func accountDeletionGracePeriod() time.Duration {
+	return utils.GetEnvDuration("ACCOUNT_DELETION_GRACE_PERIOD", 30*24*time.Hour)
+}
+
+// DeleteAccount schedules the user's account for deletion after the grace
+// period and signs them out everywhere. Signing in again before then cancels
+// the deletion; afterwards db.PurgeDeletedUsers removes the account for good.
+func (h *AuthHandler) DeleteAccount(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	grace := accountDeletionGracePeriod()
+
+	var username, email string
+	var scheduledFor time.Time
+	err := h.db.QueryRow(`
+		UPDATE users
+		SET deletion_requested_at = NOW(), deletion_scheduled_for = NOW() + $2 * INTERVAL '1 second'
+		WHERE id = $1
+		RETURNING username, email, deletion_scheduled_for`,
+		userID, int64(grace.Seconds())).Scan(&username, &email, &scheduledFor)
+	if err != nil {
+		log.Printf("Error scheduling account deletion: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "account_deletion_requested", "Account scheduled for deletion", c)
+	recordAudit(h.db, c, "account_deletion_requested", "user", userID, map[string]interface{}{
+		"scheduled_for": scheduledFor.UTC().Format(time.RFC3339),
+	})
+
+	if err := h.revokeAllTokens(userID); err != nil {
+		log.Printf("Error revoking tokens for deleted account: %v", err)
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nYour WIRA Dashboard account is scheduled to be deleted on %s. "+
+		"Until then you can keep it by signing in again at %s\n\n"+
+		"If you did not ask to delete your account, sign in and change your password.\n",
+		username, scheduledFor.UTC().Format("2 January 2006 15:04 MST"), utils.AppURL("/login"))
+	go func() {
+		if err := h.mailer.Send(email, "Your WIRA Dashboard account will be deleted", body); err != nil {
+			log.Printf("Error sending account deletion email: %v", err)
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":                "Account scheduled for deletion",
+		"deletion_scheduled_for": scheduledFor,
+	})
+}
+
+// cancelAccountDeletion restores an account that is waiting to be deleted
+// when its owner signs in during the grace period
+func (h *AuthHandler) cancelAccountDeletion(c *gin.Context, userID int) {
+	result, err := h.db.Exec(`
+		UPDATE users SET deletion_requested_at = NULL, deletion_scheduled_for = NULL
+		WHERE id = $1 AND deletion_requested_at IS NOT NULL`, userID)
+	if err != nil {
+		log.Printf("Error cancelling account deletion: %v", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+
+	h.LogUserActivity(userID, "account_deletion_cancelled", "Account deletion cancelled by signing in", c)
+	recordAudit(h.db, c, "account_deletion_cancelled", "user", userID, nil)
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"wira-dashboard/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// activityExportLimit caps how many activities a single export returns
+const activityExportLimit = 10000
+
+// activityBatchSize is how many activities queryAllActivities reads per query
+const activityBatchSize = 1000
+
+// activityFilter holds the activity_type and from/to (RFC 3339) filters shared
+// by the activity history and its export
+type activityFilter struct {
+	activityType string
+	from, to     *time.Time
+}
+
+// parseActivityFilter reads the activity filters from the query string,
+// responding with 400 if one is malformed
+func parseActivityFilter(c *gin.Context) (activityFilter, bool) {
+	f := activityFilter{activityType: c.Query("activity_type")}
+	var ok bool
+	f.from, f.to, ok = parseTimeRange(c)
+	return f, ok
+}
+
+// encodeActivityCursor returns an opaque cursor pointing after the activity
+func encodeActivityCursor(a models.Activity) string {
+	raw := a.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + strconv.Itoa(a.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeActivityCursor parses a cursor returned by encodeActivityCursor
+func decodeActivityCursor(cursor string) (time.Time, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, fmt.Errorf("malformed cursor")
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return createdAt, id, nil
+}
+
+// queryActivities returns up to limit of the user's activities matching the
+// filter, newest first, starting after the (createdAt, id) cursor if set
+func queryActivities(database *sql.DB, userID interface{}, f activityFilter, afterTime *time.Time, afterID, limit int) ([]models.Activity, error) {
+	rows, err := database.Query(`
+		SELECT id, activity_type, COALESCE(description, ''), COALESCE(ip_address, ''),
+			COALESCE(user_agent, ''), created_at
+		FROM user_activities
+		WHERE user_id = $1
+			AND ($2 = '' OR activity_type = $2)
+			AND ($3::timestamptz IS NULL OR created_at >= $3)
+			AND ($4::timestamptz IS NULL OR created_at < $4)
+			AND ($5::timestamptz IS NULL OR (created_at, id) < ($5, $6))
+		ORDER BY created_at DESC, id DESC
+		LIMIT $7`,
+		userID, f.activityType, f.from, f.to, afterTime, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activities := []models.Activity{}
+	for rows.Next() {
+		var a models.Activity
+		if err := rows.Scan(&a.ID, &a.Type, &a.Description, &a.IPAddress, &a.UserAgent, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		activities = append(activities, a)
+	}
+	return activities, rows.Err()
+}
+
+// queryAllActivities returns all of the user's activities matching the
+// filter, newest first, reading them activityBatchSize at a time
+func queryAllActivities(database *sql.DB, userID interface{}, f activityFilter) ([]models.Activity, error) {
+	activities := []models.Activity{}
+	var afterTime *time.Time
+	afterID := 0
+	for {
+		batch, err := queryActivities(database, userID, f, afterTime, afterID, activityBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		activities = append(activities, batch...)
+		if len(batch) < activityBatchSize {
+			return activities, nil
+		}
+		last := batch[len(batch)-1]
+		afterTime, afterID = &last.CreatedAt, last.ID
+	}
+}
+
+// GetUserActivities returns a page of the user's activities, newest first,
+// filtered by activity_type and a from/to date range. Pass next_cursor from
+// the response as cursor to get the next page.
+func (h *AuthHandler) GetUserActivities(c *gin.Context) {
+	// Get user ID from context (set by AuthMiddleware)
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	filter, ok := parseActivityFilter(c)
+	if !ok {
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
+		return
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	var afterTime *time.Time
+	var afterID int
+	if cursor := c.Query("cursor"); cursor != "" {
+		t, id, err := decodeActivityCursor(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor parameter"})
+			return
+		}
+		afterTime, afterID = &t, id
+	}
+
+	// Fetch one extra row to know whether there is a next page
+	activities, err := queryActivities(h.db, userID, filter, afterTime, afterID, limit+1)
+	if err != nil {
+		log.Printf("Error fetching activities: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch activities"})
+		return
+	}
+
+	var nextCursor *string
+	if len(activities) > limit {
+		activities = activities[:limit]
+		cursor := encodeActivityCursor(activities[limit-1])
+		nextCursor = &cursor
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"activities":  activities,
+		"next_cursor": nextCursor,
+	})
+}
+
+// csvCell prefixes a value that a spreadsheet would read as a formula with a
+// quote, so text such as a user agent cannot run when the export is opened
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// ExportUserActivities downloads the user's activities matching the
+// activity_type and from/to filters as CSV (format=csv, the default) or JSON
+// (format=json)
+func (h *AuthHandler) ExportUserActivities(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format parameter"})
+		return
+	}
+
+	filter, ok := parseActivityFilter(c)
+	if !ok {
+		return
+	}
+
+	activities, err := queryActivities(h.db, userID, filter, nil, 0, activityExportLimit)
+	if err != nil {
+		log.Printf("Error exporting activities: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch activities"})
+		return
+	}
+
+	filename := "activities-" + time.Now().UTC().Format("20060102") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	if format == "json" {
+		c.JSON(http.StatusOK, gin.H{"activities": activities})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "timestamp", "type", "description", "ip_address", "user_agent"})
+	for _, a := range activities {
+		w.Write([]string{
+			strconv.Itoa(a.ID),
+			a.CreatedAt.UTC().Format(time.RFC3339),
+			csvCell(a.Type),
+			csvCell(a.Description),
+			csvCell(a.IPAddress),
+			csvCell(a.UserAgent),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Error writing activities CSV: %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"wira-dashboard/models"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminUserColumns selects a models.AdminUser, see scanAdminUser
+const adminUserColumns = `
+	u.id, u.username, u.email, u.role, u.email_verified, COALESCE(u.two_factor_enabled, false),
+	u.disabled_at, u.disabled_reason, u.deletion_scheduled_for,
+	(SELECT COUNT(*) FROM refresh_tokens rt WHERE rt.user_id = u.id AND rt.expires_at > NOW()),
+	(SELECT MAX(ua.created_at) FROM user_activities ua WHERE ua.user_id = u.id AND ua.activity_type = 'login'),
+	u.created_at`
+
+// scanAdminUser scans a row selected with adminUserColumns
+func scanAdminUser(row interface{ Scan(...interface{}) error }) (models.AdminUser, error) {
+	var u models.AdminUser
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.EmailVerified, &u.TwoFactorEnabled,
+		&u.DisabledAt, &u.DisabledReason, &u.DeletionScheduledFor, &u.ActiveSessions, &u.LastLoginAt, &u.CreatedAt)
+	return u, err
+}
+
+// adminTargetUser parses the :id parameter and returns the user's username
+// and email, responding with an error if there is no such user
+func (h *AuthHandler) adminTargetUser(c *gin.Context) (int, string, string, bool) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return 0, "", "", false
+	}
+
+	var username, email string
+	err = h.db.QueryRow("SELECT username, email FROM users WHERE id = $1", userID).Scan(&username, &email)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return 0, "", "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return 0, "", "", false
+	}
+	return userID, username, email, true
+}
+
+// adminManageableUser is adminTargetUser for actions taken against the
+// user's account. It refuses users whose role ranks the same as or above the
+// actor's, so moderators cannot act on admins or on each other.
+func (h *AuthHandler) adminManageableUser(c *gin.Context) (int, string, string, bool) {
+	userID, username, email, ok := h.adminTargetUser(c)
+	if !ok {
+		return 0, "", "", false
+	}
+
+	// A role missing from roles ranks below every real role for the actor
+	// and as the lowest real role for the target
+	var actorRank, targetRank int
+	err := h.db.QueryRow(`
+		SELECT
+			COALESCE((SELECT r.rank FROM users u JOIN roles r ON r.name = u.role WHERE u.id = $1), -1),
+			COALESCE((SELECT r.rank FROM users u JOIN roles r ON r.name = u.role WHERE u.id = $2), 0)`,
+		c.GetInt("user_id"), userID).Scan(&actorRank, &targetRank)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return 0, "", "", false
+	}
+	if targetRank >= actorRank {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot manage a user whose role is the same as or higher than yours"})
+		return 0, "", "", false
+	}
+	return userID, username, email, true
+}
+
+// ListUsers lists dashboard users, optionally searching usernames and emails
+// with q and filtering by role and status (active or disabled)
+func (h *AuthHandler) ListUsers(c *gin.Context) {
+	p, ok := parsePagination(c, 20)
+	if !ok {
+		return
+	}
+
+	search := ""
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		search = "%" + q + "%"
+	}
+	role := c.Query("role")
+	status := c.Query("status")
+	if status != "" && status != "active" && status != "disabled" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status parameter"})
+		return
+	}
+
+	filter := `
+		WHERE ($1 = '' OR u.username ILIKE $1 OR u.email ILIKE $1)
+			AND ($2 = '' OR u.role = $2)
+			AND ($3 = '' OR ($3 = 'disabled') = (u.disabled_at IS NOT NULL))`
+
+	var total int
+	err := h.db.QueryRow(`SELECT COUNT(*) FROM users u`+filter, search, role, status).Scan(&total)
+	if err != nil {
+		log.Printf("Error counting users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rows, err := h.db.Query(`SELECT `+adminUserColumns+` FROM users u`+filter+`
+		ORDER BY u.id
+		LIMIT $4 OFFSET $5`, search, role, status, p.perPage, p.offset())
+	if err != nil {
+		log.Printf("Error listing users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	users := []models.AdminUser{}
+	for rows.Next() {
+		u, err := scanAdminUser(rows)
+		if err != nil {
+			log.Printf("Error scanning user: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		users = append(users, u)
+	}
+
+	c.JSON(http.StatusOK, models.PaginatedResponse{
+		Total:   total,
+		Page:    p.page,
+		PerPage: p.perPage,
+		Data:    users,
+	})
+}
+
+// GetUser returns a single dashboard user
+func (h *AuthHandler) GetUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	u, err := scanAdminUser(h.db.QueryRow(`SELECT `+adminUserColumns+` FROM users u WHERE u.id = $1`, userID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, u)
+}
+
+// GetUserActivitiesAdmin returns a page of a user's activities, newest first
+func (h *AuthHandler) GetUserActivitiesAdmin(c *gin.Context) {
+	userID, _, _, ok := h.adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	p, ok := parsePagination(c, 50)
+	if !ok {
+		return
+	}
+
+	var total int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM user_activities WHERE user_id = $1", userID).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, activity_type, COALESCE(description, ''), COALESCE(ip_address, ''), COALESCE(user_agent, ''), created_at
+		FROM user_activities
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`, userID, p.perPage, p.offset())
+	if err != nil {
+		log.Printf("Error fetching activities: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	activities := []models.Activity{}
+	for rows.Next() {
+		var a models.Activity
+		if err := rows.Scan(&a.ID, &a.Type, &a.Description, &a.IPAddress, &a.UserAgent, &a.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		activities = append(activities, a)
+	}
+
+	c.JSON(http.StatusOK, models.PaginatedResponse{
+		Total:   total,
+		Page:    p.page,
+		PerPage: p.perPage,
+		Data:    activities,
+	})
+}
+
+// ForcePasswordReset invalidates the user's password, signs them out
+// everywhere and emails them a reset link
+func (h *AuthHandler) ForcePasswordReset(c *gin.Context) {
+	userID, username, email, ok := h.adminManageableUser(c)
+	if !ok {
+		return
+	}
+
+	// Replace the password with a random one nobody knows
+	random, err := utils.GenerateEmailToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error resetting password"})
+		return
+	}
+	hash, err := utils.HashPassword(random)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error resetting password"})
+		return
+	}
+	if _, err := h.db.Exec("UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", hash, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if err := h.revokeAllTokens(userID); err != nil {
+		log.Printf("Error revoking tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := h.sendPasswordResetEmail(userID, username, email); err != nil {
+		log.Printf("Error creating password reset email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error sending password reset email"})
+		return
+	}
+
+	h.LogUserActivity(userID, "password_reset_forced", fmt.Sprintf("Password reset forced by user %d", c.GetInt("user_id")), c)
+	recordAudit(h.db, c, "password_reset_forced", "user", userID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset email sent and sessions revoked"})
+}
+
+// ResetUser2FA removes every second factor of the user: the TOTP secret,
+// recovery codes and security keys
+func (h *AuthHandler) ResetUser2FA(c *gin.Context) {
+	userID, _, _, ok := h.adminManageableUser(c)
+	if !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		`UPDATE users SET two_factor_enabled = false, two_factor_secret = NULL, two_factor_last_used = NULL,
+			two_factor_pending_secret = NULL, two_factor_pending_expires_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		`DELETE FROM two_factor_recovery_codes WHERE user_id = $1`,
+		`DELETE FROM webauthn_credentials WHERE user_id = $1`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, userID); err != nil {
+			log.Printf("Error resetting 2FA: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "2fa_reset", fmt.Sprintf("2FA reset by user %d", c.GetInt("user_id")), c)
+	recordAudit(h.db, c, "2fa_reset", "user", userID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "2FA has been reset"})
+}
+
+// RevokeUserSessions signs the user out of every session
+func (h *AuthHandler) RevokeUserSessions(c *gin.Context) {
+	userID, _, _, ok := h.adminManageableUser(c)
+	if !ok {
+		return
+	}
+
+	if err := h.revokeAllTokens(userID); err != nil {
+		log.Printf("Error revoking tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "sessions_revoked", fmt.Sprintf("All sessions revoked by user %d", c.GetInt("user_id")), c)
+	recordAudit(h.db, c, "sessions_revoked", "user", userID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Sessions revoked"})
+}
+
+// DisableUser blocks the user from logging in and signs them out everywhere
+func (h *AuthHandler) DisableUser(c *gin.Context) {
+	userID, _, _, ok := h.adminManageableUser(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason" binding:"required,max=1000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required"})
+		return
+	}
+
+	_, err := h.db.Exec(`
+		UPDATE users SET disabled_at = NOW(), disabled_reason = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2`, req.Reason, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := h.revokeAllTokens(userID); err != nil {
+		log.Printf("Error revoking tokens: %v", err)
+	}
+
+	h.LogUserActivity(userID, "account_disabled", fmt.Sprintf("Account disabled by user %d: %s", c.GetInt("user_id"), req.Reason), c)
+	recordAudit(h.db, c, "account_disabled", "user", userID, map[string]interface{}{"reason": req.Reason})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account disabled"})
+}
+
+// EnableUser lets a disabled user log in again
+func (h *AuthHandler) EnableUser(c *gin.Context) {
+	userID, _, _, ok := h.adminManageableUser(c)
+	if !ok {
+		return
+	}
+
+	_, err := h.db.Exec(`
+		UPDATE users SET disabled_at = NULL, disabled_reason = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "account_enabled", fmt.Sprintf("Account enabled by user %d", c.GetInt("user_id")), c)
+	recordAudit(h.db, c, "account_enabled", "user", userID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account enabled"})
+}
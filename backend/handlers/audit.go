@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"wira-dashboard/db"
+	"wira-dashboard/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordAudit appends a security or admin event to the audit log. The actor
+// is the authenticated user, if any. Failures are logged but do not fail the
+// request.
+func recordAudit(database *sql.DB, c *gin.Context, action, targetType string, targetID interface{}, metadata map[string]interface{}) {
+	entry := models.AuditEntry{
+		ActorUsername: c.GetString("username"),
+		Action:        action,
+		TargetType:    targetType,
+		Metadata:      metadata,
+		IPAddress:     c.ClientIP(),
+		UserAgent:     c.Request.UserAgent(),
+	}
+	if userID, exists := c.Get("user_id"); exists {
+		id := userID.(int)
+		entry.ActorID = &id
+	}
+	if targetID != nil {
+		entry.TargetID = fmt.Sprint(targetID)
+	}
+	if err := db.AppendAudit(database, entry); err != nil {
+		log.Printf("Error writing audit log entry %s: %v", action, err)
+	}
+}
+
+// GetAuditLog lists audit log entries, newest first, filtered by action,
+// actor_id, target_type, target_id and a from/to date range (RFC 3339). The
+// actor's username, IP address and user agent are empty once the actor's
+// account has been purged.
+func (h *AuthHandler) GetAuditLog(c *gin.Context) {
+	p, ok := parsePagination(c, 50)
+	if !ok {
+		return
+	}
+
+	var actorID int
+	if v := c.Query("actor_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid actor_id parameter"})
+			return
+		}
+		actorID = id
+	}
+	from, to, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+
+	filter := `
+		WHERE ($1 = '' OR action = $1)
+			AND ($2 = 0 OR audit_log.actor_id = $2)
+			AND ($3 = '' OR target_type = $3)
+			AND ($4 = '' OR target_id = $4)
+			AND ($5::timestamptz IS NULL OR created_at >= $5)
+			AND ($6::timestamptz IS NULL OR created_at < $6)`
+	args := []interface{}{c.Query("action"), actorID, c.Query("target_type"), c.Query("target_id"), from, to}
+
+	var total int
+	if err := h.db.QueryRow(`SELECT COUNT(*) FROM audit_log`+filter, args...).Scan(&total); err != nil {
+		log.Printf("Error counting audit log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, created_at, audit_log.actor_id, COALESCE(a.actor_username, ''), action, target_type,
+			target_id, metadata, COALESCE(a.ip_address, ''), COALESCE(a.user_agent, ''), prev_hash, hash
+		FROM audit_log
+		LEFT JOIN audit_log_actors a ON a.audit_id = audit_log.id`+filter+`
+		ORDER BY id DESC
+		LIMIT $7 OFFSET $8`, append(args, p.perPage, p.offset())...)
+	if err != nil {
+		log.Printf("Error fetching audit log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var e models.AuditEntry
+		var metadata []byte
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.ActorUsername, &e.Action, &e.TargetType,
+			&e.TargetID, &metadata, &e.IPAddress, &e.UserAgent, &e.PrevHash, &e.Hash); err != nil {
+			log.Printf("Error scanning audit log: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+			log.Printf("Error decoding audit metadata: %v", err)
+		}
+		entries = append(entries, e)
+	}
+
+	c.JSON(http.StatusOK, models.PaginatedResponse{
+		Total:   total,
+		Page:    p.page,
+		PerPage: p.perPage,
+		Data:    entries,
+	})
+}
+
+// VerifyAuditLog checks the audit log hash chain
+func (h *AuthHandler) VerifyAuditLog(c *gin.Context) {
+	result, err := db.VerifyAuditLog(h.db)
+	if err != nil {
+		log.Printf("Error verifying audit log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
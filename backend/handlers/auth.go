@@ -2,22 +2,49 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 	"log"
 	"wira-dashboard/models"
 	"wira-dashboard/utils"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthHandler struct {
-	db *sql.DB
+	db       *sql.DB
+	lockout  lockoutConfig
+	totp     *utils.TOTPConfig
+	secrets  *utils.SecretBox
+	webauthn *webauthn.WebAuthn
+	mailer   utils.Mailer
+	blobs    utils.BlobStore
+	password *utils.PasswordPolicy
+	// dummyHash is compared against when the username does not exist so the
+	// response time does not reveal whether it does
+	dummyHash string
 }
 
-func NewAuthHandler(db *sql.DB) *AuthHandler {
-	return &AuthHandler{db: db}
+func NewAuthHandler(db *sql.DB, secrets *utils.SecretBox, totp *utils.TOTPConfig, webAuthn *webauthn.WebAuthn, mailer utils.Mailer, blobs utils.BlobStore) *AuthHandler {
+	dummyHash, err := utils.HashPassword("dummy-password-for-timing")
+	if err != nil {
+		log.Printf("Error generating dummy password hash: %v", err)
+	}
+	return &AuthHandler{
+		db:        db,
+		lockout:   loadLockoutConfig(),
+		totp:      totp,
+		secrets:   secrets,
+		webauthn:  webAuthn,
+		mailer:    mailer,
+		blobs:     blobs,
+		password:  utils.LoadPasswordPolicy(),
+		dummyHash: dummyHash,
+	}
 }
 
 // Register handles user registration
@@ -51,6 +78,10 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
+	if !h.validatePassword(c, "password", req.Password, req.Username, req.Email) {
+		return
+	}
+
 	// Hash password
 	hashedPassword, err := utils.HashPassword(req.Password)
 	if err != nil {
@@ -61,8 +92,8 @@ func (h *AuthHandler) Register(c *gin.Context) {
 	// Create user
 	var userID int
 	err = h.db.QueryRow(`
-		INSERT INTO users (username, email, password_hash, created_at, updated_at)
-		VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		INSERT INTO users (username, email, password_hash, email_verified, created_at, updated_at)
+		VALUES ($1, $2, $3, false, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
 		RETURNING id`,
 		req.Username, req.Email, hashedPassword).Scan(&userID)
 	if err != nil {
@@ -73,34 +104,20 @@ func (h *AuthHandler) Register(c *gin.Context) {
 	// Log registration
 	h.LogUserActivity(userID, "register", "New user registration", c)
 
-	// Generate tokens
-	token, err := utils.GenerateJWT(userID, req.Username)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
-		return
-	}
-
-	refreshToken, err := utils.GenerateRefreshToken()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating refresh token"})
-		return
+	// Ask the user to confirm their address
+	if err := h.sendVerificationEmail(userID, req.Username, req.Email); err != nil {
+		log.Printf("Error creating verification email: %v", err)
 	}
 
-	// Store refresh token
-	_, err = h.db.Exec(`
-		INSERT INTO refresh_tokens (user_id, token, expires_at)
-		VALUES ($1, $2, $3)`,
-		userID, refreshToken, time.Now().Add(time.Hour*24*30))
+	// Generate tokens
+	tokens, err := h.issueTokens(c, userID, req.Username)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing refresh token"})
+		log.Printf("Error issuing tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, models.TokenResponse{
-		AccessToken:  token,
-		RefreshToken: refreshToken,
-		ExpiresIn:    3600,
-	})
+	c.JSON(http.StatusCreated, tokens)
 }
 
 // Login handles user login
@@ -111,18 +128,33 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	log.Printf("Login request for user: %s, has 2FA code: %v", req.Username, req.TOTPCode != "")
+	log.Printf("Login request for user: %s", req.Username)
+
+	// Reject attempts while the username or IP is locked out
+	attempt, wait, err := h.beginAttempt(req.Username, c.ClientIP(), "password")
+	if err != nil {
+		log.Printf("Error checking lockout: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if wait > 0 {
+		rejectLockedOut(c, wait)
+		return
+	}
 
 	// Get user from database
 	var user models.User
-	err := h.db.QueryRow(`
-		SELECT id, username, password_hash, two_factor_enabled, two_factor_secret
+	var disabled bool
+	err = h.db.QueryRow(`
+		SELECT id, username, password_hash, two_factor_enabled, two_factor_secret, disabled_at IS NOT NULL
 		FROM users WHERE username = $1`,
-		req.Username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.TwoFactorEnabled, &user.TwoFactorSecret)
+		req.Username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.TwoFactorEnabled, &user.TwoFactorSecret, &disabled)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			// Log failed login attempt
-			h.LogUserActivity(0, "login_failed", "Failed login attempt: user not found", c)
+			// Spend the same time as a real password check
+			utils.CheckPassword(req.Password, h.dummyHash)
+			// There is no user to log the activity against
+			recordSecurityEvent(h.db, c, securityEventUnknownUser, req.Username)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 			return
 		}
@@ -139,89 +171,273 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+	attempt.succeeded()
 
-	// Check 2FA if enabled
-	if user.TwoFactorEnabled {
-		log.Printf("2FA is enabled, code provided: %v", req.TOTPCode != "")
-		if req.TOTPCode == "" {
-			log.Printf("No 2FA code provided, requesting 2FA")
-			c.JSON(http.StatusOK, gin.H{
-				"requires_2fa": true,
-				"message": "2FA code required",
-			})
-			return
-		}
-		if !utils.Validate2FACode(user.TwoFactorSecret.String, req.TOTPCode) {
-			log.Printf("Invalid 2FA code provided")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid 2FA code"})
+	// Only tell who knows the password that the account is disabled
+	if disabled {
+		h.LogUserActivity(user.ID, "login_failed", "Failed login attempt: account disabled", c)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	// Ask for the second factor if a TOTP app or security key is set up
+	hasWebAuthn, err := h.hasWebAuthnCredentials(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if user.TwoFactorEnabled || hasWebAuthn {
+		log.Printf("2FA is enabled, issuing challenge token")
+		methods := secondFactorMethods(user.TwoFactorEnabled, hasWebAuthn)
+		challengeToken, err := h.issueChallengeToken(user.ID, user.Username)
+		if err != nil {
+			log.Printf("Error issuing challenge token: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
 			return
 		}
-		log.Printf("2FA code validated successfully")
+		c.JSON(http.StatusOK, gin.H{
+			"requires_2fa":    true,
+			"challenge_token": challengeToken,
+			"expires_in":      int(utils.ChallengeTokenExpiry.Seconds()),
+			"methods":         methods,
+			"message":         "2FA code required",
+		})
+		return
 	}
 
-	// Generate tokens
-	token, err := utils.GenerateJWT(user.ID, user.Username)
+	h.completeLogin(c, user.ID, user.Username)
+}
+
+// Verify2FA completes a 2FA login by exchanging a challenge token and a TOTP
+// code for access and refresh tokens
+func (h *AuthHandler) Verify2FA(c *gin.Context) {
+	var req models.Verify2FARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.TOTPCode == "" && req.RecoveryCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "totp_code or recovery_code is required"})
+		return
+	}
+
+	claims, err := utils.ValidateTokenType(req.ChallengeToken, utils.TokenType2FAChallenge)
 	if err != nil {
-		log.Printf("Error generating JWT: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
 		return
 	}
+	userID := int((*claims)["user_id"].(float64))
+	username := (*claims)["username"].(string)
+	jti := (*claims)["jti"].(string)
 
-	refreshToken, err := utils.GenerateRefreshToken()
+	attempt, wait, err := h.beginAttempt(username, c.ClientIP(), "totp")
 	if err != nil {
-		log.Printf("Error generating refresh token: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating refresh token"})
+		log.Printf("Error checking lockout: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if wait > 0 {
+		rejectLockedOut(c, wait)
 		return
 	}
 
-	// Store refresh token
-	_, err = h.db.Exec(`
-		INSERT INTO refresh_tokens (user_id, token, expires_at)
-		VALUES ($1, $2, $3)`,
-		user.ID, refreshToken, time.Now().Add(time.Hour*24*30))
+	var secret sql.NullString
+	var enabled bool
+	err = h.db.QueryRow("SELECT two_factor_secret, two_factor_enabled FROM users WHERE id = $1", userID).Scan(&secret, &enabled)
+	if err == sql.ErrNoRows || (err == nil && !enabled) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+		return
+	}
 	if err != nil {
-		log.Printf("Error storing refresh token: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing refresh token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// The challenge token and the code are consumed together: the challenge
+	// row stays locked until the transaction ends, so a concurrent request
+	// waits and then finds it used, and a wrong code rolls back and leaves the
+	// challenge usable for another try
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
+	defer tx.Rollback()
+
+	var challengeUserID int
+	err = tx.QueryRow(`
+		UPDATE login_challenges
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE jti = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id`, jti).Scan(&challengeUserID)
+	if err == sql.ErrNoRows || (err == nil && challengeUserID != userID) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Accept either a TOTP code or a one-time recovery code
+	var valid bool
+	if req.RecoveryCode != "" {
+		valid, err = useRecoveryCode(tx, userID, req.RecoveryCode)
+	} else {
+		valid, err = h.verifyTOTP(tx, userID, secret.String, req.TOTPCode)
+	}
+	if err != nil {
+		log.Printf("Error verifying 2FA code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !valid {
+		tx.Rollback()
+		log.Printf("Invalid 2FA code provided")
+		h.LogUserActivity(userID, "login_failed", "Failed login attempt: invalid 2FA code", c)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid 2FA code"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	attempt.succeeded()
+	if req.RecoveryCode != "" {
+		h.logRecoveryCodeUse(c, userID)
+	}
+
+	log.Printf("2FA code validated successfully")
+	h.completeLogin(c, userID, username)
+}
+
+// completeLogin issues tokens once every login factor has been verified
+func (h *AuthHandler) completeLogin(c *gin.Context, userID int, username string) {
+	var disabled bool
+	err := h.db.QueryRow("SELECT disabled_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&disabled)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if disabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	// Generate tokens
+	tokens, err := h.issueTokens(c, userID, username)
+	if err != nil {
+		log.Printf("Error issuing tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
+		return
+	}
+
+	h.clearFailedAttempts(username)
+	h.cancelAccountDeletion(c, userID)
 
 	// Log successful login
-	h.LogUserActivity(user.ID, "login", "User logged in successfully", c)
+	h.LogUserActivity(userID, "login", "User logged in successfully", c)
 
-	log.Printf("Login successful for user: %s", req.Username)
+	log.Printf("Login successful for user: %s", username)
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token": token,
-		"refresh_token": refreshToken,
-		"expires_in": 3600,
-	})
+	c.JSON(http.StatusOK, tokens)
 }
 
-// Setup2FA initiates 2FA setup for a user
+// Setup2FA initiates 2FA setup for a user. The new secret is kept as a
+// pending secret until Enable2FA confirms it, so an existing 2FA setup keeps
+// working in the meantime.
 func (h *AuthHandler) Setup2FA(c *gin.Context) {
 	userID := c.GetInt("user_id")
+	username := c.GetString("username")
 
 	// Generate 2FA secret
-	secret, qrURL, err := utils.Generate2FASecret()
+	secret, qrURL, err := h.totp.GenerateSecret(username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating 2FA secret"})
 		return
 	}
 
-	// Store secret temporarily (it will be confirmed in Enable2FA)
-	_, err = h.db.Exec("UPDATE users SET two_factor_secret = $1 WHERE id = $2", secret, userID)
+	encryptedSecret, err := h.encryptTOTPSecret(userID, secret)
+	if err != nil {
+		log.Printf("Error encrypting 2FA secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating 2FA secret"})
+		return
+	}
+
+	// Store the pending secret (it will be confirmed in Enable2FA)
+	expiry := utils.GetEnvDuration("TOTP_SETUP_EXPIRY", 15*time.Minute)
+	_, err = h.db.Exec(`
+		UPDATE users
+		SET two_factor_pending_secret = $1, two_factor_pending_expires_at = $2
+		WHERE id = $3`,
+		encryptedSecret, time.Now().Add(expiry), userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"secret": secret,
-		"qr_url": qrURL,
+		"secret":     secret,
+		"qr_url":     qrURL,
+		"expires_in": int(expiry.Seconds()),
 	})
 }
 
-// Enable2FA confirms and enables 2FA for a user
+// Get2FAQRCode renders the pending 2FA secret as a QR code image, as PNG by
+// default or as SVG with ?format=svg
+func (h *AuthHandler) Get2FAQRCode(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var pendingSecret string
+	err := h.db.QueryRow(`
+		SELECT two_factor_pending_secret FROM users
+		WHERE id = $1 AND two_factor_pending_secret IS NOT NULL
+			AND two_factor_pending_expires_at > NOW()`, userID).Scan(&pendingSecret)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No pending 2FA setup"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	secret, err := h.secrets.Decrypt(pendingSecret, utils.TOTPSecretAAD(userID))
+	if err != nil {
+		log.Printf("Error decrypting 2FA secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating QR code"})
+		return
+	}
+	qrURL, err := h.totp.KeyURL(secret, c.GetString("username"))
+	if err != nil {
+		log.Printf("Error building 2FA URL: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating QR code"})
+		return
+	}
+
+	// The image contains the secret, so it must never be cached
+	c.Header("Cache-Control", "no-store")
+
+	if c.Query("format") == "svg" {
+		image, err := utils.QRCodeSVG(qrURL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating QR code"})
+			return
+		}
+		c.Data(http.StatusOK, "image/svg+xml", image)
+		return
+	}
+
+	image, err := utils.QRCodePNG(qrURL, 256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating QR code"})
+		return
+	}
+	c.Data(http.StatusOK, "image/png", image)
+}
+
+// Enable2FA confirms the pending secret and enables 2FA for a user
 func (h *AuthHandler) Enable2FA(c *gin.Context) {
 	var req models.Enable2FARequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -231,28 +447,61 @@ func (h *AuthHandler) Enable2FA(c *gin.Context) {
 
 	userID := c.GetInt("user_id")
 
-	// Get user's temporary secret
+	// Get user's pending secret
 	var secret string
-	err := h.db.QueryRow("SELECT two_factor_secret FROM users WHERE id = $1", userID).Scan(&secret)
+	err := h.db.QueryRow(`
+		SELECT two_factor_pending_secret FROM users
+		WHERE id = $1 AND two_factor_pending_secret IS NOT NULL
+			AND two_factor_pending_expires_at > NOW()`, userID).Scan(&secret)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No pending 2FA setup or it has expired"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
 	// Validate TOTP code
-	if !utils.Validate2FACode(secret, req.TOTPCode) {
+	valid, err := h.verifyTOTP(h.db, userID, secret, req.TOTPCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !valid {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 2FA code"})
 		return
 	}
 
-	// Enable 2FA
-	_, err = h.db.Exec("UPDATE users SET two_factor_enabled = true WHERE id = $1", userID)
+	// Enable 2FA with the confirmed secret
+	_, err = h.db.Exec(`
+		UPDATE users
+		SET two_factor_secret = two_factor_pending_secret,
+			two_factor_enabled = true,
+			two_factor_pending_secret = NULL,
+			two_factor_pending_expires_at = NULL
+		WHERE id = $1 AND two_factor_pending_secret = $2`, userID, secret)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "2FA enabled successfully"})
+	// Generate recovery codes, shown to the user only once
+	recoveryCodes, err := h.generateRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating recovery codes"})
+		return
+	}
+
+	h.LogUserActivity(userID, "2fa_enabled", "2FA enabled", c)
+	recordAudit(h.db, c, "2fa_enabled", "user", userID, nil)
+	h.LogUserActivity(userID, "recovery_codes_generated", "2FA recovery codes generated", c)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "2FA enabled successfully",
+		"recovery_codes": recoveryCodes,
+	})
 }
 
 // Disable2FA disables 2FA for a user
@@ -262,13 +511,24 @@ func (h *AuthHandler) Disable2FA(c *gin.Context) {
 	_, err := h.db.Exec(`
 		UPDATE users 
 		SET two_factor_enabled = false, 
-			two_factor_secret = NULL 
+			two_factor_secret = NULL,
+			two_factor_pending_secret = NULL,
+			two_factor_pending_expires_at = NULL
 		WHERE id = $1`, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
+	_, err = h.db.Exec("DELETE FROM two_factor_recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "2fa_disabled", "2FA disabled", c)
+	recordAudit(h.db, c, "2fa_disabled", "user", userID, nil)
+
 	c.JSON(http.StatusOK, gin.H{"message": "2FA disabled successfully"})
 }
 
@@ -289,8 +549,16 @@ func (h *AuthHandler) Get2FAStatus(c *gin.Context) {
 		return
 	}
 
+	remaining, err := h.remainingRecoveryCodes(userID.(int))
+	if err != nil {
+		log.Printf("Error counting recovery codes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"two_factor_enabled": twoFactorEnabled,
+		"two_factor_enabled":       twoFactorEnabled,
+		"recovery_codes_remaining": remaining,
 	})
 }
 
@@ -303,14 +571,14 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	}
 
 	// Verify refresh token
-	var userID int
+	var userID, sessionID int
 	var username string
 	err := h.db.QueryRow(`
-		SELECT u.id, u.username 
+		SELECT u.id, u.username, rt.id
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
-		WHERE rt.token = $1 AND rt.expires_at > NOW()`,
-		refreshToken).Scan(&userID, &username)
+		WHERE rt.token = $1 AND rt.expires_at > NOW() AND u.disabled_at IS NULL`,
+		refreshToken).Scan(&userID, &username, &sessionID)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
 		return
@@ -320,8 +588,18 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 		return
 	}
 
+	// Record session usage
+	_, err = h.db.Exec(`
+		UPDATE refresh_tokens
+		SET last_used_at = CURRENT_TIMESTAMP, ip_address = $1, user_agent = $2
+		WHERE id = $3`,
+		c.ClientIP(), c.Request.UserAgent(), sessionID)
+	if err != nil {
+		log.Printf("Error updating session usage: %v", err)
+	}
+
 	// Generate new access token
-	newToken, err := utils.GenerateJWT(userID, username)
+	newToken, err := h.issueAccessToken(userID, username, sessionID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
 		return
@@ -333,6 +611,65 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	})
 }
 
+// Logout revokes the presented refresh token and, if an access token is
+// supplied, adds it to the denylist
+func (h *AuthHandler) Logout(c *gin.Context) {
+	refreshToken := c.GetHeader("X-Refresh-Token")
+	if refreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refresh token required"})
+		return
+	}
+
+	var userID int
+	err := h.db.QueryRow(`
+		DELETE FROM refresh_tokens
+		WHERE token = $1
+		RETURNING user_id`,
+		refreshToken).Scan(&userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Revoke the access token as well when it belongs to the same user
+	if parts := strings.Split(c.GetHeader("Authorization"), " "); len(parts) == 2 && parts[0] == "Bearer" {
+		if claims, err := utils.ValidateTokenType(parts[1], utils.TokenTypeAccess); err == nil {
+			jti, _ := (*claims)["jti"].(string)
+			tokenUserID, _ := (*claims)["user_id"].(float64)
+			if jti != "" && int(tokenUserID) == userID {
+				if err := h.revokeAccessToken(jti, userID); err != nil {
+					log.Printf("Error revoking access token: %v", err)
+				}
+			}
+		}
+	}
+
+	h.LogUserActivity(userID, "logout", "User logged out", c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// LogoutAll revokes every refresh token and outstanding access token for the
+// authenticated user
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	if err := h.revokeAllTokens(userID); err != nil {
+		log.Printf("Error revoking tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "logout_all", "User logged out of all sessions", c)
+	recordAudit(h.db, c, "logout_all", "user", userID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+}
+
 // GetProfile handles fetching the user's profile
 func (h *AuthHandler) GetProfile(c *gin.Context) {
 	// Get user ID from context (set by AuthMiddleware)
@@ -345,15 +682,8 @@ func (h *AuthHandler) GetProfile(c *gin.Context) {
 		return
 	}
 
-	// Query the database for user information
-	var user struct {
-		ID       int    `json:"id"`
-		Username string `json:"username"`
-		Email    string `json:"email"`
-	}
-	
 	log.Printf("GetProfile - Querying database for user ID: %v", userID)
-	err := h.db.QueryRow("SELECT id, username, email FROM users WHERE id = $1", userID).Scan(&user.ID, &user.Username, &user.Email)
+	user, err := h.loadProfile(userID.(int))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Printf("GetProfile - User not found in database: %v", userID)
@@ -379,7 +709,7 @@ func (h *AuthHandler) ChangePassword(c *gin.Context) {
 
 	var req struct {
 		CurrentPassword string `json:"current_password" binding:"required"`
-		NewPassword    string `json:"new_password" binding:"required,min=8"`
+		NewPassword    string `json:"new_password" binding:"required"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -388,8 +718,8 @@ func (h *AuthHandler) ChangePassword(c *gin.Context) {
 	}
 
 	// Get current password hash from database
-	var currentHash string
-	err := h.db.QueryRow("SELECT password_hash FROM users WHERE id = $1", userID).Scan(&currentHash)
+	var currentHash, username, email string
+	err := h.db.QueryRow("SELECT password_hash, username, email FROM users WHERE id = $1", userID).Scan(&currentHash, &username, &email)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to verify current password"})
 		return
@@ -402,6 +732,10 @@ func (h *AuthHandler) ChangePassword(c *gin.Context) {
 		return
 	}
 
+	if !h.validatePassword(c, "new_password", req.NewPassword, username, email) {
+		return
+	}
+
 	// Hash new password
 	newHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
 	if err != nil {
@@ -418,65 +752,148 @@ func (h *AuthHandler) ChangePassword(c *gin.Context) {
 
 	// Log password change
 	h.LogUserActivity(userID.(int), "password_change", "Password changed successfully", c)
+	recordAudit(h.db, c, "password_change", "user", userID, nil)
 
 	c.JSON(200, gin.H{"message": "Password updated successfully"})
 }
 
-// GetUserActivities returns the user's recent activities
-func (h *AuthHandler) GetUserActivities(c *gin.Context) {
-	// Get user ID from context (set by AuthMiddleware)
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
+// validatePassword checks a new password against the password policy and
+// responds with 400 and the problems under the field name if it fails
+func (h *AuthHandler) validatePassword(c *gin.Context, field, password string, personal ...string) bool {
+	problems := h.password.Validate(password, personal...)
+	if len(problems) == 0 {
+		return true
 	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":  "Password does not meet the requirements",
+		"fields": gin.H{field: problems},
+	})
+	return false
+}
 
-	// Query recent activities
-	rows, err := h.db.Query(`
-		SELECT activity_type, description, created_at 
-		FROM user_activities 
-		WHERE user_id = $1 
-		ORDER BY created_at DESC 
-		LIMIT 10`, userID)
+// LogUserActivity logs a new user activity. Events without a user belong in
+// security_events (see recordSecurityEvent).
+func (h *AuthHandler) LogUserActivity(userID int, activityType string, description string, c *gin.Context) error {
+	if userID <= 0 {
+		log.Printf("Refusing to log %s activity without a user", activityType)
+		return fmt.Errorf("no user for activity %s", activityType)
+	}
+	_, err := h.db.Exec(`
+		INSERT INTO user_activities (user_id, activity_type, description, ip_address, user_agent)
+		VALUES ($1, $2, $3, $4, $5)`,
+		userID, activityType, description, c.ClientIP(), c.Request.UserAgent())
 	if err != nil {
-		log.Printf("Error fetching activities: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch activities"})
-		return
+		log.Printf("Error logging activity: %v", err)
+		return err
 	}
-	defer rows.Close()
+	return nil
+}
 
-	var activities []struct {
-		Type        string    `json:"type"`
-		Description string    `json:"description"`
-		CreatedAt   time.Time `json:"timestamp"`
+// issueTokens generates an access token and a refresh token for a user and
+// stores them, recording the client's user agent and IP on the session
+func (h *AuthHandler) issueTokens(c *gin.Context, userID int, username string) (*models.TokenResponse, error) {
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return nil, err
 	}
 
-	for rows.Next() {
-		var activity struct {
-			Type        string    `json:"type"`
-			Description string    `json:"description"`
-			CreatedAt   time.Time `json:"timestamp"`
-		}
-		if err := rows.Scan(&activity.Type, &activity.Description, &activity.CreatedAt); err != nil {
-			log.Printf("Error scanning activity row: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process activities"})
-			return
-		}
-		activities = append(activities, activity)
+	// Store refresh token
+	var sessionID int
+	err = h.db.QueryRow(`
+		INSERT INTO refresh_tokens (user_id, token, expires_at, user_agent, ip_address, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
+		RETURNING id`,
+		userID, refreshToken, time.Now().Add(time.Hour*24*30), c.Request.UserAgent(), c.ClientIP()).Scan(&sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := h.issueAccessToken(userID, username, sessionID)
+	if err != nil {
+		return nil, err
 	}
 
-	c.JSON(http.StatusOK, gin.H{"activities": activities})
+	return &models.TokenResponse{
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(utils.TokenExpiry.Seconds()),
+	}, nil
 }
 
-// LogUserActivity logs a new user activity
-func (h *AuthHandler) LogUserActivity(userID int, activityType string, description string, c *gin.Context) error {
-	_, err := h.db.Exec(`
-		INSERT INTO user_activities (user_id, activity_type, description, ip_address)
+// issueAccessToken generates a JWT carrying the user's current role and
+// permissions and records its jti against the session it was issued for so
+// it can be revoked
+func (h *AuthHandler) issueAccessToken(userID int, username string, sessionID int) (string, error) {
+	role, permissions, err := h.loadRole(userID)
+	if err != nil {
+		return "", err
+	}
+
+	token, jti, err := utils.GenerateJWT(userID, username, role, permissions)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO access_tokens (jti, user_id, session_id, expires_at)
 		VALUES ($1, $2, $3, $4)`,
-		userID, activityType, description, c.ClientIP())
+		jti, userID, sessionID, time.Now().Add(utils.TokenExpiry))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// issueChallengeToken generates a single-use 2FA challenge token and
+// records its jti
+func (h *AuthHandler) issueChallengeToken(userID int, username string) (string, error) {
+	token, jti, err := utils.GenerateChallengeToken(userID, username)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO login_challenges (jti, user_id, expires_at)
+		VALUES ($1, $2, $3)`,
+		jti, userID, time.Now().Add(utils.ChallengeTokenExpiry))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// revokeAccessToken adds a single access token to the denylist
+func (h *AuthHandler) revokeAccessToken(jti string, userID int) error {
+	_, err := h.db.Exec(`
+		INSERT INTO revoked_tokens (jti, user_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (jti) DO NOTHING`,
+		jti, userID, time.Now().Add(utils.TokenExpiry))
+	return err
+}
+
+// revokeAllTokens deletes all refresh tokens of a user and adds every
+// outstanding access token to the denylist
+func (h *AuthHandler) revokeAllTokens(userID int) error {
+	tx, err := h.db.Begin()
 	if err != nil {
-		log.Printf("Error logging activity: %v", err)
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO revoked_tokens (jti, user_id, expires_at)
+		SELECT jti, user_id, expires_at
+		FROM access_tokens
+		WHERE user_id = $1 AND expires_at > NOW()
+		ON CONFLICT (jti) DO NOTHING`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
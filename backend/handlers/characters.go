@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"database/sql"
+	"wira-dashboard/models"
+
+	"github.com/lib/pq"
+)
+
+// loadCharacterSummaries returns the characters of the given game accounts
+// with their score statistics, ignoring voided scores. The class rank is the
+// account's position on the class leaderboard, ranked the same way as
+// GetRankings, and is null while the account is banned.
+func loadCharacterSummaries(db *sql.DB, accIDs []int) ([]models.CharacterSummary, error) {
+	rows, err := db.Query(`
+		WITH wanted AS (
+			SELECT ch.char_id, ch.acc_id, ch.class_id, a.username
+			FROM characters ch
+			JOIN accounts a ON a.acc_id = ch.acc_id
+			WHERE ch.acc_id = ANY($1)
+		),
+		class_ranks AS (
+			SELECT
+				c.acc_id,
+				c.class_id,
+				DENSE_RANK() OVER (PARTITION BY c.class_id ORDER BY MAX(s.reward_score) DESC) as rank
+			FROM characters c
+			JOIN accounts a ON a.acc_id = c.acc_id
+			JOIN scores s ON c.char_id = s.char_id
+			WHERE c.class_id IN (SELECT class_id FROM wanted)
+				AND s.voided_at IS NULL
+				AND (a.banned_at IS NULL OR a.banned_until <= NOW())
+			GROUP BY c.acc_id, c.class_id
+		)
+		SELECT
+			w.char_id,
+			w.acc_id,
+			w.username,
+			w.class_id,
+			MAX(s.reward_score),
+			ROUND(AVG(s.reward_score)::numeric, 2)::float8,
+			(ARRAY_AGG(s.reward_score ORDER BY s.created_at DESC, s.score_id DESC))[1],
+			MAX(s.created_at),
+			COUNT(s.score_id),
+			r.rank
+		FROM wanted w
+		LEFT JOIN scores s ON s.char_id = w.char_id AND s.voided_at IS NULL
+		LEFT JOIN class_ranks r ON r.acc_id = w.acc_id AND r.class_id = w.class_id
+		GROUP BY w.char_id, w.acc_id, w.username, w.class_id, r.rank
+		ORDER BY w.username, w.class_id, w.char_id`, pq.Array(accIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	characters := []models.CharacterSummary{}
+	for rows.Next() {
+		var ch models.CharacterSummary
+		if err := rows.Scan(&ch.CharID, &ch.AccID, &ch.Username, &ch.ClassID, &ch.BestScore,
+			&ch.AverageScore, &ch.LastScore, &ch.LastPlayedAt, &ch.RunCount, &ch.ClassRank); err != nil {
+			return nil, err
+		}
+		characters = append(characters, ch)
+	}
+	return characters, rows.Err()
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// emailVerificationExpiry is how long an email verification link is valid,
+// read from EMAIL_VERIFICATION_EXPIRY
+func emailVerificationExpiry() time.Duration {
+	return utils.GetEnvDuration("EMAIL_VERIFICATION_EXPIRY", 48*time.Hour)
+}
+
+// Purposes of email verification tokens
+const (
+	emailTokenVerify = "verify" // confirms the user's current address
+	emailTokenChange = "change" // confirms a new address before switching to it
+)
+
+// createEmailToken stores a new email token for the user and address,
+// replacing any earlier token with the same purpose, and returns it
+func (h *AuthHandler) createEmailToken(userID int, email, purpose string, expiry time.Duration) (string, error) {
+	token, err := utils.GenerateEmailToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM email_verification_tokens WHERE user_id = $1 AND purpose = $2", userID, purpose); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO email_verification_tokens (user_id, email, purpose, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		userID, email, purpose, utils.HashToken(token), time.Now().Add(expiry))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// sendVerificationEmail emails a link confirming that the user owns the
+// address. Any earlier link for the user stops working.
+func (h *AuthHandler) sendVerificationEmail(userID int, username, email string) error {
+	expiry := emailVerificationExpiry()
+	token, err := h.createEmailToken(userID, email, emailTokenVerify, expiry)
+	if err != nil {
+		return err
+	}
+
+	link := utils.AppURL("/verify-email?token=" + url.QueryEscape(token))
+	body := fmt.Sprintf("Hi %s,\n\nPlease confirm your email address for WIRA Dashboard by opening the link below. "+
+		"It expires in %s.\n\n%s\n\n"+
+		"If you did not create an account, you can ignore this email.\n",
+		username, expiry, link)
+
+	go func() {
+		if err := h.mailer.Send(email, "Verify your WIRA Dashboard email", body); err != nil {
+			log.Printf("Error sending verification email: %v", err)
+		}
+	}()
+	return nil
+}
+
+// sendEmailChangeConfirmation emails a link to the new address that switches
+// the user's email to it, and tells the current address about the request.
+// Any earlier pending change stops working.
+func (h *AuthHandler) sendEmailChangeConfirmation(userID int, username, currentEmail, newEmail string) error {
+	expiry := emailVerificationExpiry()
+	token, err := h.createEmailToken(userID, newEmail, emailTokenChange, expiry)
+	if err != nil {
+		return err
+	}
+
+	link := utils.AppURL("/verify-email?token=" + url.QueryEscape(token))
+	confirm := fmt.Sprintf("Hi %s,\n\nOpen the link below to make this the email address of your WIRA Dashboard account. "+
+		"It expires in %s.\n\n%s\n\n"+
+		"If you did not ask for this, you can ignore this email.\n",
+		username, expiry, link)
+	notice := fmt.Sprintf("Hi %s,\n\nSomeone asked to change the email address of your WIRA Dashboard account to %s. "+
+		"Nothing changes until the new address is confirmed.\n\n"+
+		"If this was not you, sign in and change your password.\n",
+		username, newEmail)
+
+	go func() {
+		if err := h.mailer.Send(newEmail, "Confirm your new WIRA Dashboard email", confirm); err != nil {
+			log.Printf("Error sending email change confirmation: %v", err)
+		}
+		if err := h.mailer.Send(currentEmail, "Your WIRA Dashboard email is being changed", notice); err != nil {
+			log.Printf("Error sending email change notice: %v", err)
+		}
+	}()
+	return nil
+}
+
+// VerifyEmail marks the user's email as verified using the token from a
+// verification link. A token from an email change link also switches the
+// user's email to the new address.
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email, purpose string
+	err = tx.QueryRow(`
+		DELETE FROM email_verification_tokens
+		WHERE token_hash = $1 AND expires_at > NOW()
+		RETURNING user_id, email, purpose`,
+		utils.HashToken(req.Token)).Scan(&userID, &email, &purpose)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+
+	if purpose == emailTokenChange {
+		h.confirmEmailChange(c, tx, userID, email)
+		return
+	}
+
+	// The link only verifies the address it was sent to
+	result, err := tx.Exec(`
+		UPDATE users SET email_verified = true, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND email = $2`, userID, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "email_verified", "Email address verified", c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+// confirmEmailChange switches the user's email to the new address from an
+// email change link, which also verifies it, commits tx and lets the old
+// address know
+func (h *AuthHandler) confirmEmailChange(c *gin.Context, tx *sql.Tx, userID int, email string) {
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 AND id <> $2)", email, userID).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
+		return
+	}
+
+	var username, oldEmail string
+	err = tx.QueryRow(`
+		UPDATE users u SET email = $2, email_verified = true, updated_at = CURRENT_TIMESTAMP
+		FROM (SELECT email FROM users WHERE id = $1) old
+		WHERE u.id = $1
+		RETURNING u.username, old.email`, userID, email).Scan(&username, &oldEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update email"})
+		return
+	}
+	// Links sent to the old address are no longer needed
+	if _, err := tx.Exec("DELETE FROM email_verification_tokens WHERE user_id = $1", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "email_change", "Email changed successfully", c)
+	recordAudit(h.db, c, "email_change", "user", userID, nil)
+
+	body := fmt.Sprintf("Hi %s,\n\nThe email address of your WIRA Dashboard account was changed to %s.\n\n"+
+		"If this was not you, reset your password and contact an administrator.\n",
+		username, email)
+	go func() {
+		if err := h.mailer.Send(oldEmail, "Your WIRA Dashboard email was changed", body); err != nil {
+			log.Printf("Error sending email changed notice: %v", err)
+		}
+	}()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email updated successfully"})
+}
+
+// ResendVerificationEmail sends a new verification link to the user's
+// current address
+func (h *AuthHandler) ResendVerificationEmail(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var username, email string
+	var verified bool
+	err := h.db.QueryRow("SELECT username, email, email_verified FROM users WHERE id = $1", userID).Scan(&username, &email, &verified)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if verified {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is already verified"})
+		return
+	}
+
+	if err := h.sendVerificationEmail(userID, username, email); err != nil {
+		log.Printf("Error creating verification email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error sending verification email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
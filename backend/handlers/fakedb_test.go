@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is an in-memory stand-in for the Postgres tables the WebAuthn
+// handlers touch. It is served through database/sql so the handlers run
+// unchanged; statements are recognised by the fragments below and anything
+// else fails the request, so a new query shows up as a test failure.
+type fakeDB struct {
+	mu          sync.Mutex
+	users       map[int]*fakeUser
+	credentials []*fakeCredential
+	sessions    map[string]*fakeSession
+	challenges  map[string]*fakeChallenge
+	activities  []string // activity types, in the order they were logged
+	audit       []string // audit actions
+	failures    []*fakeFailure
+	events      []string // security event types
+	reauthed    map[string]bool
+	nextID      int
+}
+
+type fakeUser struct {
+	username     string
+	passwordHash string
+	handle       []byte
+}
+
+type fakeCredential struct {
+	id              int
+	userID          int
+	credentialID    []byte
+	publicKey       []byte
+	attestationType string
+	transports      string
+	aaguid          []byte
+	signCount       int64
+	backupEligible  bool
+	backupState     bool
+}
+
+type fakeSession struct {
+	purpose   string
+	userID    int64
+	jti       string
+	data      string
+	expiresAt time.Time
+}
+
+type fakeFailure struct {
+	id          int64
+	username    string
+	ip          string
+	attemptType string
+	at          time.Time
+}
+
+type fakeChallenge struct {
+	userID int
+	used   bool
+}
+
+var (
+	fakeDBs      sync.Map // DSN -> *fakeDB
+	fakeDBNextID int64
+	fakeDBMu     sync.Mutex
+)
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// newFakeDB opens a fresh fake database, closed when the test ends
+func newFakeDB(t *testing.T) (*fakeDB, *sql.DB) {
+	t.Helper()
+
+	fakeDBMu.Lock()
+	fakeDBNextID++
+	dsn := strconv.FormatInt(fakeDBNextID, 10)
+	fakeDBMu.Unlock()
+
+	fake := &fakeDB{
+		users:      make(map[int]*fakeUser),
+		sessions:   make(map[string]*fakeSession),
+		challenges: make(map[string]*fakeChallenge),
+		reauthed:   make(map[string]bool),
+	}
+	fakeDBs.Store(dsn, fake)
+
+	database, err := sql.Open("fakedb", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		fakeDBs.Delete(dsn)
+	})
+	return fake, database
+}
+
+// credentialFor returns the stored credential with the given ID
+func (db *fakeDB) credentialFor(credentialID []byte) *fakeCredential {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, cred := range db.credentials {
+		if bytes.Equal(cred.credentialID, credentialID) {
+			return cred
+		}
+	}
+	return nil
+}
+
+// hasActivity reports whether an activity of the type was logged
+func (db *fakeDB) hasActivity(activityType string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, a := range db.activities {
+		if a == activityType {
+			return true
+		}
+	}
+	return false
+}
+
+// failureTypes lists the types of the stored failed attempts
+func (db *fakeDB) failureTypes() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	types := []string{}
+	for _, f := range db.failures {
+		types = append(types, f.attemptType)
+	}
+	return types
+}
+
+// fakeResult is what a statement produced
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+// exec runs one statement against the in-memory tables
+func (db *fakeDB) exec(query string, args []driver.NamedValue) (*fakeResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	arg := func(i int) driver.Value { return args[i].Value }
+	str := func(i int) string { s, _ := arg(i).(string); return s }
+	num := func(i int) int64 { n, _ := arg(i).(int64); return n }
+	blob := func(i int) []byte { b, _ := arg(i).([]byte); return b }
+	row := func(columns []string, values ...driver.Value) *fakeResult {
+		return &fakeResult{columns: columns, rows: [][]driver.Value{values}}
+	}
+	none := func(columns ...string) *fakeResult { return &fakeResult{columns: columns} }
+	has := func(fragment string) bool { return strings.Contains(query, fragment) }
+
+	switch {
+	// users
+	case has("SELECT username, webauthn_user_handle FROM users"):
+		u, ok := db.users[int(num(0))]
+		if !ok {
+			return none("username", "webauthn_user_handle"), nil
+		}
+		return row([]string{"username", "webauthn_user_handle"}, u.username, nullBytes(u.handle)), nil
+	case has("UPDATE users SET webauthn_user_handle"):
+		u, ok := db.users[int(num(1))]
+		if !ok || u.handle != nil {
+			return &fakeResult{}, nil
+		}
+		u.handle = blob(0)
+		return &fakeResult{affected: 1}, nil
+	case has("SELECT webauthn_user_handle FROM users"):
+		u, ok := db.users[int(num(0))]
+		if !ok {
+			return none("webauthn_user_handle"), nil
+		}
+		return row([]string{"webauthn_user_handle"}, nullBytes(u.handle)), nil
+	case has("SELECT id FROM users WHERE webauthn_user_handle"):
+		for id, u := range db.users {
+			if u.handle != nil && bytes.Equal(u.handle, blob(0)) {
+				return row([]string{"id"}, int64(id)), nil
+			}
+		}
+		return none("id"), nil
+	case has("SELECT password_hash, two_factor_secret, two_factor_enabled"):
+		u, ok := db.users[int(num(0))]
+		if !ok {
+			return none("password_hash", "two_factor_secret", "two_factor_enabled"), nil
+		}
+		return row([]string{"password_hash", "two_factor_secret", "two_factor_enabled"}, u.passwordHash, nil, false), nil
+	case has("SELECT disabled_at IS NOT NULL FROM users"):
+		return row([]string{"disabled"}, false), nil
+	case has("UPDATE users SET deletion_requested_at = NULL"):
+		return &fakeResult{}, nil
+	case has("ARRAY_AGG(rp.permission"):
+		return row([]string{"role", "permissions"}, "user", []byte("{}")), nil
+
+	// webauthn_credentials
+	case has("SELECT EXISTS(SELECT 1 FROM webauthn_credentials"):
+		for _, cred := range db.credentials {
+			if cred.userID == int(num(0)) {
+				return row([]string{"exists"}, true), nil
+			}
+		}
+		return row([]string{"exists"}, false), nil
+	case has("SELECT credential_id, public_key, attestation_type"):
+		result := none("credential_id", "public_key", "attestation_type", "transports", "aaguid",
+			"sign_count", "backup_eligible", "backup_state")
+		for _, cred := range db.credentials {
+			if cred.userID == int(num(0)) {
+				result.rows = append(result.rows, []driver.Value{cred.credentialID, cred.publicKey,
+					cred.attestationType, cred.transports, cred.aaguid, cred.signCount,
+					cred.backupEligible, cred.backupState})
+			}
+		}
+		return result, nil
+	case has("INSERT INTO webauthn_credentials"):
+		db.nextID++
+		db.credentials = append(db.credentials, &fakeCredential{
+			id:              db.nextID,
+			userID:          int(num(0)),
+			credentialID:    blob(1),
+			publicKey:       blob(2),
+			attestationType: str(3),
+			transports:      str(4),
+			aaguid:          blob(5),
+			signCount:       num(6),
+			backupEligible:  arg(7).(bool),
+			backupState:     arg(8).(bool),
+		})
+		return row([]string{"id"}, int64(db.nextID)), nil
+	case has("UPDATE webauthn_credentials"):
+		for _, cred := range db.credentials {
+			if bytes.Equal(cred.credentialID, blob(2)) && cred.userID == int(num(3)) {
+				cred.signCount = num(0)
+				cred.backupState = arg(1).(bool)
+				return &fakeResult{affected: 1}, nil
+			}
+		}
+		return &fakeResult{}, nil
+
+	// webauthn_sessions
+	case has("INSERT INTO webauthn_sessions"):
+		db.sessions[str(0)] = &fakeSession{
+			purpose:   str(1),
+			userID:    num(2),
+			jti:       str(3),
+			data:      str(4),
+			expiresAt: arg(5).(time.Time),
+		}
+		return &fakeResult{affected: 1}, nil
+	case has("DELETE FROM webauthn_sessions"):
+		columns := []string{"user_id", "challenge_jti", "data"}
+		s, ok := db.sessions[str(0)]
+		if !ok || s.purpose != str(1) || !s.expiresAt.After(time.Now()) {
+			return none(columns...), nil
+		}
+		delete(db.sessions, str(0))
+		var userID, jti driver.Value
+		if s.userID != 0 {
+			userID = s.userID
+		}
+		if s.jti != "" {
+			jti = s.jti
+		}
+		return row(columns, userID, jti, s.data), nil
+
+	// login_challenges and tokens
+	case has("UPDATE login_challenges"):
+		ch, ok := db.challenges[str(0)]
+		if !ok || ch.used || ch.userID != int(num(1)) {
+			return &fakeResult{}, nil
+		}
+		ch.used = true
+		return &fakeResult{affected: 1}, nil
+	case has("INSERT INTO refresh_tokens"):
+		db.nextID++
+		return row([]string{"id"}, int64(db.nextID)), nil
+	case has("INSERT INTO access_tokens"):
+		return &fakeResult{affected: 1}, nil
+	case has("SET reauthenticated_at = CURRENT_TIMESTAMP"):
+		db.reauthed[str(0)] = true
+		return &fakeResult{affected: 1}, nil
+
+	// lockout, activity and audit bookkeeping
+	case has("COUNT(*) FILTER"):
+		var usernameCount, ipCount int64
+		usernameLast, ipLast := time.Unix(0, 0), time.Unix(0, 0)
+		for _, f := range db.failures {
+			if f.username == str(0) {
+				usernameCount++
+				usernameLast = f.at
+			}
+			if f.ip == str(1) {
+				ipCount++
+				ipLast = f.at
+			}
+		}
+		return row([]string{"a", "b", "c", "d"}, usernameCount, usernameLast, ipCount, ipLast), nil
+	case has("INSERT INTO security_events"):
+		db.events = append(db.events, str(0))
+		return &fakeResult{affected: 1}, nil
+	case has("FROM security_events"):
+		return row([]string{"count", "max"}, int64(0), time.Unix(0, 0)), nil
+	case has("INSERT INTO failed_attempts"):
+		db.nextID++
+		db.failures = append(db.failures, &fakeFailure{
+			id: int64(db.nextID), username: str(0), ip: str(1), attemptType: str(2), at: time.Now(),
+		})
+		return row([]string{"id"}, int64(db.nextID)), nil
+	case has("DELETE FROM failed_attempts"):
+		kept := db.failures[:0]
+		for _, f := range db.failures {
+			if (has("WHERE id") && f.id == num(0)) || (has("WHERE username") && f.username == str(0)) {
+				continue
+			}
+			kept = append(kept, f)
+		}
+		db.failures = kept
+		return &fakeResult{}, nil
+	case has("INSERT INTO user_activities"):
+		db.activities = append(db.activities, str(1))
+		return &fakeResult{affected: 1}, nil
+	case has("pg_advisory_xact_lock"):
+		return none(), nil
+	case has("SELECT hash FROM audit_log"):
+		return none("hash"), nil
+	case has("INSERT INTO audit_log_actors"):
+		return &fakeResult{affected: 1}, nil
+	case has("INSERT INTO audit_log"):
+		db.nextID++
+		db.audit = append(db.audit, str(2))
+		return row([]string{"id"}, int64(db.nextID)), nil
+	}
+	return nil, fmt.Errorf("fakedb: unexpected statement: %s", strings.Join(strings.Fields(query), " "))
+}
+
+// nullBytes stores a missing byte slice as NULL
+func nullBytes(b []byte) driver.Value {
+	if b == nil {
+		return nil
+	}
+	return b
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	db, ok := fakeDBs.Load(dsn)
+	if !ok {
+		return nil, fmt.Errorf("fakedb: unknown database %q", dsn)
+	}
+	return &fakeConn{db: db.(*fakeDB)}, nil
+}
+
+// fakeConn runs statements directly; transactions are not isolated
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fakedb: prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := c.db.exec(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(result.affected), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	result, err := c.db.exec(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{result: result}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	result *fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"wira-dashboard/models"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gameLinkCodeExpiry is how long a code shown in-game can be used, read from
+// GAME_LINK_CODE_EXPIRY
+func gameLinkCodeExpiry() time.Duration {
+	return utils.GetEnvDuration("GAME_LINK_CODE_EXPIRY", 10*time.Minute)
+}
+
+// CreateGameLinkCode is called by the game server to get a one-time code that
+// the player types into the dashboard to link their game account. Any earlier
+// code for the account stops working.
+func (h *AuthHandler) CreateGameLinkCode(c *gin.Context) {
+	var req struct {
+		AccID int `json:"acc_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM accounts WHERE acc_id = $1)", req.AccID).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Game account not found"})
+		return
+	}
+
+	code, err := utils.GenerateLinkCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating link code"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM game_link_codes WHERE acc_id = $1", req.AccID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	expiry := gameLinkCodeExpiry()
+	_, err = tx.Exec(`
+		INSERT INTO game_link_codes (code_hash, acc_id, expires_at)
+		VALUES ($1, $2, $3)`,
+		utils.HashToken(utils.NormalizeLinkCode(code)), req.AccID, time.Now().Add(expiry))
+	if err != nil {
+		log.Printf("Error storing game link code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"code":       code,
+		"expires_in": int(expiry.Seconds()),
+	})
+}
+
+// LinkGameAccount links the game account a one-time code was issued for to
+// the authenticated user
+func (h *AuthHandler) LinkGameAccount(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var link models.GameAccountLink
+	err = tx.QueryRow(`
+		DELETE FROM game_link_codes g
+		USING accounts a
+		WHERE g.acc_id = a.acc_id AND g.code_hash = $1 AND g.expires_at > NOW()
+		RETURNING a.acc_id, a.username`,
+		utils.HashToken(utils.NormalizeLinkCode(req.Code))).Scan(&link.AccID, &link.Username)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired link code"})
+		return
+	}
+
+	// A game account can only belong to one dashboard user
+	var ownerID int
+	err = tx.QueryRow(`
+		INSERT INTO user_game_accounts (user_id, acc_id)
+		VALUES ($1, $2)
+		ON CONFLICT (acc_id) DO UPDATE SET acc_id = EXCLUDED.acc_id
+		RETURNING user_id, linked_at`,
+		userID, link.AccID).Scan(&ownerID, &link.LinkedAt)
+	if err != nil {
+		log.Printf("Error linking game account: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if ownerID != userID {
+		c.JSON(http.StatusConflict, gin.H{"error": "Game account is already linked to another user"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "game_account_linked", fmt.Sprintf("Game account linked: %s", link.Username), c)
+
+	c.JSON(http.StatusCreated, link)
+}
+
+// GetGameAccounts lists the game accounts linked to the user
+func (h *AuthHandler) GetGameAccounts(c *gin.Context) {
+	links, err := h.loadGameAccountLinks(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"game_accounts": links})
+}
+
+// loadGameAccountLinks returns the game accounts linked to the user, oldest
+// link first
+func (h *AuthHandler) loadGameAccountLinks(userID int) ([]models.GameAccountLink, error) {
+	rows, err := h.db.Query(`
+		SELECT a.acc_id, a.username, l.linked_at
+		FROM user_game_accounts l
+		JOIN accounts a ON a.acc_id = l.acc_id
+		WHERE l.user_id = $1
+		ORDER BY l.linked_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []models.GameAccountLink{}
+	for rows.Next() {
+		var link models.GameAccountLink
+		if err := rows.Scan(&link.AccID, &link.Username, &link.LinkedAt); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// UnlinkGameAccount removes the link between the user and a game account
+func (h *AuthHandler) UnlinkGameAccount(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	accID, err := strconv.Atoi(c.Param("acc_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid game account ID"})
+		return
+	}
+
+	var username string
+	err = h.db.QueryRow(`
+		DELETE FROM user_game_accounts l
+		USING accounts a
+		WHERE l.acc_id = a.acc_id AND l.user_id = $1 AND l.acc_id = $2
+		RETURNING a.username`, userID, accID).Scan(&username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Game account not linked"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "game_account_unlinked", fmt.Sprintf("Game account unlinked: %s", username), c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Game account unlinked"})
+}
+
+// GetUserCharacters returns the characters of the user's linked game
+// accounts with their best score and per-class rank
+func (h *AuthHandler) GetUserCharacters(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	rows, err := h.db.Query("SELECT acc_id FROM user_game_accounts WHERE user_id = $1", userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	var accIDs []int
+	for rows.Next() {
+		var accID int
+		if err := rows.Scan(&accID); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		accIDs = append(accIDs, accID)
+	}
+	rows.Close()
+
+	characters, err := loadCharacterSummaries(h.db, accIDs)
+	if err != nil {
+		log.Printf("Error loading characters: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"characters": characters})
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// lockoutConfig holds the brute-force protection thresholds. Failures are
+// counted within Window; after DelayThreshold failures each further attempt
+// must wait an exponentially growing delay, and after the lockout threshold
+// the username or IP is locked until Window has passed since the last failure.
+// An IP that tries UnknownUserThreshold unknown usernames within Window is
+// locked the same way, to slow down username enumeration.
+type lockoutConfig struct {
+	Window               time.Duration
+	DelayThreshold       int
+	BaseDelay            time.Duration
+	MaxDelay             time.Duration
+	UsernameThreshold    int
+	IPThreshold          int
+	UnknownUserThreshold int
+}
+
+// loadLockoutConfig reads the lockout thresholds from the environment
+func loadLockoutConfig() lockoutConfig {
+	return lockoutConfig{
+		Window:               utils.GetEnvDuration("LOCKOUT_WINDOW", 15*time.Minute),
+		DelayThreshold:       utils.GetEnvInt("LOCKOUT_DELAY_THRESHOLD", 3),
+		BaseDelay:            utils.GetEnvDuration("LOCKOUT_BASE_DELAY", time.Second),
+		MaxDelay:             utils.GetEnvDuration("LOCKOUT_MAX_DELAY", time.Minute),
+		UsernameThreshold:    utils.GetEnvInt("LOCKOUT_USERNAME_THRESHOLD", 10),
+		IPThreshold:          utils.GetEnvInt("LOCKOUT_IP_THRESHOLD", 50),
+		UnknownUserThreshold: utils.GetEnvInt("LOCKOUT_UNKNOWN_USER_THRESHOLD", 20),
+	}
+}
+
+// delayFor returns how long to wait after the last failure once failures
+// attempts have failed
+func (cfg lockoutConfig) delayFor(failures int) time.Duration {
+	if failures < cfg.DelayThreshold {
+		return 0
+	}
+	delay := float64(cfg.BaseDelay) * math.Pow(2, float64(failures-cfg.DelayThreshold))
+	if delay > float64(cfg.MaxDelay) {
+		return cfg.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// loginAttempt is a login or re-authentication attempt that beginAttempt has
+// already stored as failed
+type loginAttempt struct {
+	db *sql.DB
+	id int64
+}
+
+// beginAttempt checks the lockout for an attempt by the username from the IP
+// and, if it may proceed, stores it as a failed attempt before the
+// credentials are checked. The check and the insert run in one transaction
+// holding advisory locks on the username and the IP, so parallel guesses are
+// counted one after another instead of all passing the check before any
+// failure is stored. It returns how long the caller must wait instead if the
+// username or IP is locked out. Call succeeded once the credentials are
+// accepted.
+func (h *AuthHandler) beginAttempt(username, ip, attemptType string) (*loginAttempt, time.Duration, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	// Always username first, then IP, so two attempts cannot deadlock
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('failed_attempts:username:' || $1))", username); err != nil {
+		return nil, 0, err
+	}
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('failed_attempts:ip:' || $1))", ip); err != nil {
+		return nil, 0, err
+	}
+
+	wait, err := h.checkLockout(tx, username, ip)
+	if err != nil || wait > 0 {
+		return nil, wait, err
+	}
+
+	attempt := &loginAttempt{db: h.db}
+	err = tx.QueryRow(`
+		INSERT INTO failed_attempts (username, ip_address, attempt_type)
+		VALUES ($1, $2, $3)
+		RETURNING id`,
+		username, ip, attemptType).Scan(&attempt.id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	return attempt, 0, nil
+}
+
+// succeeded removes the attempt from the failed attempts once its
+// credentials have been accepted
+func (a *loginAttempt) succeeded() {
+	if _, err := a.db.Exec("DELETE FROM failed_attempts WHERE id = $1", a.id); err != nil {
+		log.Printf("Error clearing failed attempt: %v", err)
+	}
+}
+
+// checkLockout returns how long the caller must wait before another login
+// attempt for the username from the IP is allowed, or 0 if it may proceed
+func (h *AuthHandler) checkLockout(q queryer, username, ip string) (time.Duration, error) {
+	cfg := h.lockout
+	var usernameFailures, ipFailures int
+	var usernameLast, ipLast time.Time
+	err := q.QueryRow(`
+		SELECT
+			COUNT(*) FILTER (WHERE username = $1),
+			COALESCE(MAX(attempt_time) FILTER (WHERE username = $1), 'epoch'),
+			COUNT(*) FILTER (WHERE ip_address = $2),
+			COALESCE(MAX(attempt_time) FILTER (WHERE ip_address = $2), 'epoch')
+		FROM failed_attempts
+		WHERE (username = $1 OR ip_address = $2)
+			AND attempt_time > NOW() - $3 * INTERVAL '1 second'`,
+		username, ip, int64(cfg.Window.Seconds())).Scan(&usernameFailures, &usernameLast, &ipFailures, &ipLast)
+	if err != nil {
+		return 0, err
+	}
+
+	var wait time.Duration
+	waitUntil := func(until time.Time) {
+		if d := time.Until(until); d > wait {
+			wait = d
+		}
+	}
+
+	if usernameFailures >= cfg.UsernameThreshold {
+		waitUntil(usernameLast.Add(cfg.Window))
+	} else {
+		waitUntil(usernameLast.Add(cfg.delayFor(usernameFailures)))
+	}
+	if ipFailures >= cfg.IPThreshold {
+		waitUntil(ipLast.Add(cfg.Window))
+	}
+
+	unknownUsers, unknownLast, err := h.countUnknownUserAttempts(q, ip)
+	if err != nil {
+		return 0, err
+	}
+	if unknownUsers >= cfg.UnknownUserThreshold {
+		waitUntil(unknownLast.Add(cfg.Window))
+	}
+	return wait, nil
+}
+
+// clearFailedAttempts forgets the failed attempts for a username after a
+// successful login
+func (h *AuthHandler) clearFailedAttempts(username string) {
+	if _, err := h.db.Exec("DELETE FROM failed_attempts WHERE username = $1", username); err != nil {
+		log.Printf("Error clearing failed attempts: %v", err)
+	}
+}
+
+// rejectLockedOut responds with 429 and a Retry-After header. The message
+// is the same whether or not the username exists.
+func rejectLockedOut(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed attempts. Please try again later."})
+}
+
+// UnlockLogin clears the failed attempts for a username and/or IP address
+func (h *AuthHandler) UnlockLogin(c *gin.Context) {
+	var req struct {
+		Username  string `json:"username"`
+		IPAddress string `json:"ip_address"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Username == "" && req.IPAddress == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username or ip_address is required"})
+		return
+	}
+
+	result, err := h.db.Exec(`
+		DELETE FROM failed_attempts
+		WHERE ($1 <> '' AND username = $1) OR ($2 <> '' AND ip_address = $2)`,
+		req.Username, req.IPAddress)
+	if err != nil {
+		log.Printf("Error unlocking login: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	cleared, _ := result.RowsAffected()
+	if req.IPAddress != "" {
+		// Unknown-username attempts before this no longer count towards a lockout
+		insertSecurityEvent(h.db, securityEventLockoutCleared, "", req.IPAddress, "")
+	}
+
+	log.Printf("Login unlocked by user %d for username=%q ip=%q", c.GetInt("user_id"), req.Username, req.IPAddress)
+	// The audit log is permanent, so it names the user by ID rather than by
+	// username; a username that matches no account is not recorded at all
+	metadata := map[string]interface{}{
+		"ip_address": req.IPAddress,
+		"cleared":    cleared,
+	}
+	if req.Username != "" {
+		var userID int
+		err := h.db.QueryRow("SELECT id FROM users WHERE username = $1", req.Username).Scan(&userID)
+		switch {
+		case err == nil:
+			metadata["user_id"] = userID
+		case err == sql.ErrNoRows:
+			metadata["unknown_username"] = true
+		default:
+			log.Printf("Error looking up unlocked user: %v", err)
+		}
+	}
+	recordAudit(h.db, c, "login_unlock", "lockout", nil, metadata)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Login unlocked",
+		"cleared": cleared,
+	})
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"wira-dashboard/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// moderationRequest is the body of moderation actions. Duration is only used
+// when banning: empty means a permanent ban, otherwise the account is
+// suspended for that long (e.g. "72h").
+type moderationRequest struct {
+	Reason   string `json:"reason" binding:"required,max=1000"`
+	Duration string `json:"duration"`
+}
+
+// bindModerationRequest reads a moderationRequest with its reason trimmed,
+// responding with 400 if the body is invalid or the reason is blank
+func bindModerationRequest(c *gin.Context) (moderationRequest, bool) {
+	var req moderationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required"})
+		return req, false
+	}
+	return req, true
+}
+
+// recordModerationAction adds an action to the moderation trail
+func recordModerationAction(tx *sql.Tx, c *gin.Context, action string, accID, scoreID *int, reason string, expiresAt *time.Time) error {
+	_, err := tx.Exec(`
+		INSERT INTO moderation_actions (actor_id, action, acc_id, score_id, reason, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		c.GetInt("user_id"), action, accID, scoreID, reason, expiresAt)
+	return err
+}
+
+// VoidScore removes a score from rankings and stats without deleting it
+func (h *Handler) VoidScore(c *gin.Context) {
+	h.setScoreVoided(c, true)
+}
+
+// RestoreScore puts a voided score back on the leaderboard
+func (h *Handler) RestoreScore(c *gin.Context) {
+	h.setScoreVoided(c, false)
+}
+
+// setScoreVoided voids or restores the score in the :id parameter
+func (h *Handler) setScoreVoided(c *gin.Context, void bool) {
+	scoreID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid score ID"})
+		return
+	}
+
+	req, ok := bindModerationRequest(c)
+	if !ok {
+		return
+	}
+	reason := req.Reason
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var accID int
+	if void {
+		err = tx.QueryRow(`
+			UPDATE scores s SET voided_at = NOW(), void_reason = $2
+			FROM characters c
+			WHERE s.char_id = c.char_id AND s.score_id = $1 AND s.voided_at IS NULL
+			RETURNING c.acc_id`, scoreID, reason).Scan(&accID)
+	} else {
+		err = tx.QueryRow(`
+			UPDATE scores s SET voided_at = NULL, void_reason = NULL
+			FROM characters c
+			WHERE s.char_id = c.char_id AND s.score_id = $1 AND s.voided_at IS NOT NULL
+			RETURNING c.acc_id`, scoreID).Scan(&accID)
+	}
+	if err == sql.ErrNoRows {
+		if void {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Score not found or already voided"})
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Score not found or not voided"})
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating score: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	action := "score_restore"
+	if void {
+		action = "score_void"
+	}
+	if err := recordModerationAction(tx, c, action, &accID, &scoreID, reason, nil); err != nil {
+		log.Printf("Error recording moderation action: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	log.Printf("Moderation: %s on score %d by %s: %s", action, scoreID, c.GetString("username"), reason)
+	recordAudit(h.db, c, action, "score", scoreID, map[string]interface{}{"acc_id": accID, "reason": reason})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Score updated", "action": action})
+}
+
+// BanAccount bans a game account, or suspends it when a duration is given,
+// hiding it from rankings and stats
+func (h *Handler) BanAccount(c *gin.Context) {
+	accID, err := strconv.Atoi(c.Param("acc_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	req, ok := bindModerationRequest(c)
+	if !ok {
+		return
+	}
+	reason := req.Reason
+
+	action := "account_ban"
+	var until *time.Time
+	if req.Duration != "" {
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration"})
+			return
+		}
+		t := time.Now().Add(duration)
+		until = &t
+		action = "account_suspend"
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE accounts SET banned_at = NOW(), banned_until = $2, ban_reason = $3
+		WHERE acc_id = $1`, accID, until, reason)
+	if err != nil {
+		log.Printf("Error banning account: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+
+	if err := recordModerationAction(tx, c, action, &accID, nil, reason, until); err != nil {
+		log.Printf("Error recording moderation action: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	log.Printf("Moderation: %s on account %d by %s: %s", action, accID, c.GetString("username"), reason)
+	recordAudit(h.db, c, action, "account", accID, map[string]interface{}{"reason": reason, "banned_until": until})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Account banned",
+		"action":       action,
+		"banned_until": until,
+	})
+}
+
+// UnbanAccount lifts a ban or suspension
+func (h *Handler) UnbanAccount(c *gin.Context) {
+	accID, err := strconv.Atoi(c.Param("acc_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	req, ok := bindModerationRequest(c)
+	if !ok {
+		return
+	}
+	reason := req.Reason
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE accounts SET banned_at = NULL, banned_until = NULL, ban_reason = NULL
+		WHERE acc_id = $1 AND banned_at IS NOT NULL`, accID)
+	if err != nil {
+		log.Printf("Error unbanning account: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found or not banned"})
+		return
+	}
+
+	if err := recordModerationAction(tx, c, "account_unban", &accID, nil, reason, nil); err != nil {
+		log.Printf("Error recording moderation action: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	log.Printf("Moderation: account_unban on account %d by %s: %s", accID, c.GetString("username"), reason)
+	recordAudit(h.db, c, "account_unban", "account", accID, map[string]interface{}{"reason": reason})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account unbanned"})
+}
+
+// GetModerationActions lists the moderation trail, newest first, optionally
+// for one account with acc_id
+func (h *Handler) GetModerationActions(c *gin.Context) {
+	p, ok := parsePagination(c, 20)
+	if !ok {
+		return
+	}
+
+	accID, err := strconv.Atoi(c.DefaultQuery("acc_id", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid acc_id parameter"})
+		return
+	}
+
+	var total int
+	err = h.db.QueryRow(`
+		SELECT COUNT(*) FROM moderation_actions
+		WHERE $1 = 0 OR acc_id = $1`, accID).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT m.id, COALESCE(u.username, ''), m.action, m.acc_id, m.score_id, m.reason, m.expires_at, m.created_at
+		FROM moderation_actions m
+		LEFT JOIN users u ON u.id = m.actor_id
+		WHERE $1 = 0 OR m.acc_id = $1
+		ORDER BY m.created_at DESC, m.id DESC
+		LIMIT $2 OFFSET $3`, accID, p.perPage, p.offset())
+	if err != nil {
+		log.Printf("Error fetching moderation actions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	actions := []models.ModerationAction{}
+	for rows.Next() {
+		var a models.ModerationAction
+		if err := rows.Scan(&a.ID, &a.Actor, &a.Action, &a.AccID, &a.ScoreID, &a.Reason, &a.ExpiresAt, &a.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		actions = append(actions, a)
+	}
+
+	c.JSON(http.StatusOK, models.PaginatedResponse{
+		Total:   total,
+		Page:    p.page,
+		PerPage: p.perPage,
+		Data:    actions,
+	})
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// passwordResetExpiry is how long a password reset link is valid, read from
+// PASSWORD_RESET_EXPIRY
+func passwordResetExpiry() time.Duration {
+	return utils.GetEnvDuration("PASSWORD_RESET_EXPIRY", time.Hour)
+}
+
+// ForgotPassword emails a password reset link to the account with the given
+// address. The response is the same whether or not the address is registered.
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"message": "If the email is registered, a password reset link has been sent"}
+
+	var userID int
+	var username string
+	err := h.db.QueryRow("SELECT id, username FROM users WHERE email = $1", req.Email).Scan(&userID, &username)
+	if err != nil {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	if err := h.sendPasswordResetEmail(userID, username, req.Email); err != nil {
+		log.Printf("Error creating password reset email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "password_reset_requested", "Password reset link requested", c)
+
+	c.JSON(http.StatusOK, response)
+}
+
+// sendPasswordResetEmail emails a password reset link to the user. Only the
+// latest link is valid. The email is sent in the background so the response
+// time does not reveal whether an address is registered.
+func (h *AuthHandler) sendPasswordResetEmail(userID int, username, email string) error {
+	token, err := utils.GenerateEmailToken()
+	if err != nil {
+		return err
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM password_reset_tokens WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	expiry := passwordResetExpiry()
+	_, err = tx.Exec(`
+		INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)`,
+		userID, utils.HashToken(token), time.Now().Add(expiry))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	link := utils.AppURL("/reset-password?token=" + url.QueryEscape(token))
+	body := fmt.Sprintf("Hi %s,\n\nUse the link below to reset your WIRA Dashboard password. "+
+		"It expires in %s and can only be used once.\n\n%s\n\n"+
+		"If you did not request a password reset, you can ignore this email.\n",
+		username, expiry, link)
+
+	go func() {
+		if err := h.mailer.Send(email, "Reset your WIRA Dashboard password", body); err != nil {
+			log.Printf("Error sending password reset email: %v", err)
+		}
+	}()
+	return nil
+}
+
+// ResetPassword sets a new password using a token from a reset link and
+// signs the user out of every session
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req struct {
+		Token       string `json:"token" binding:"required"`
+		NewPassword string `json:"new_password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Consume the token so it cannot be used twice. It stays valid if the
+	// new password is rejected because the transaction is rolled back.
+	var userID int
+	var username, email string
+	err = tx.QueryRow(`
+		UPDATE password_reset_tokens t
+		SET used_at = NOW()
+		FROM users u
+		WHERE t.user_id = u.id AND t.token_hash = $1 AND t.used_at IS NULL AND t.expires_at > NOW()
+		RETURNING u.id, u.username, u.email`,
+		utils.HashToken(req.Token)).Scan(&userID, &username, &email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	if !h.validatePassword(c, "new_password", req.NewPassword, username, email) {
+		return
+	}
+	newHash, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process new password"})
+		return
+	}
+
+	_, err = tx.Exec("UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", newHash, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if err := h.revokeAllTokens(userID); err != nil {
+		log.Printf("Error revoking tokens after password reset: %v", err)
+	}
+	h.clearFailedAttempts(username)
+	h.LogUserActivity(userID, "password_reset", "Password reset via email link", c)
+	recordAudit(h.db, c, "password_reset", "user", userID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset. Please log in with your new password."})
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"wira-dashboard/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetPlayerProfile returns a game account's characters with their score
+// statistics and class ranks, and a page of its score history, newest first.
+// The history can be narrowed to one class with class_id.
+func (h *Handler) GetPlayerProfile(c *gin.Context) {
+	p, ok := parsePagination(c, 20)
+	if !ok {
+		return
+	}
+
+	classID, err := strconv.Atoi(c.DefaultQuery("class_id", "0"))
+	if err != nil || classID < 0 || classID > 8 {
+		classID = 0 // Default to all classes if invalid
+	}
+
+	var accID int
+	profile := models.PlayerProfile{}
+	err = h.db.QueryRow(`
+		SELECT acc_id, username, created_at FROM accounts
+		WHERE username = $1 AND (banned_at IS NULL OR banned_until <= NOW())`, c.Param("username")).
+		Scan(&accID, &profile.Username, &profile.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Player not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching player: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	profile.Characters, err = loadCharacterSummaries(h.db, []int{accID})
+	if err != nil {
+		log.Printf("Error loading characters: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var total int
+	err = h.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM characters c
+		JOIN scores s ON c.char_id = s.char_id
+		WHERE c.acc_id = $1 AND ($2 = 0 OR c.class_id = $2) AND s.voided_at IS NULL`, accID, classID).Scan(&total)
+	if err != nil {
+		log.Printf("Error counting score history: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT s.score_id, s.char_id, c.class_id, s.reward_score, s.created_at
+		FROM characters c
+		JOIN scores s ON c.char_id = s.char_id
+		WHERE c.acc_id = $1 AND ($2 = 0 OR c.class_id = $2) AND s.voided_at IS NULL
+		ORDER BY s.created_at DESC, s.score_id DESC
+		LIMIT $3 OFFSET $4`, accID, classID, p.perPage, p.offset())
+	if err != nil {
+		log.Printf("Error fetching score history: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	history := []models.ScoreEntry{}
+	for rows.Next() {
+		var entry models.ScoreEntry
+		if err := rows.Scan(&entry.ScoreID, &entry.CharID, &entry.ClassID, &entry.RewardScore, &entry.CreatedAt); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		history = append(history, entry)
+	}
+
+	profile.History = models.PaginatedResponse{
+		Total:   total,
+		Page:    p.page,
+		PerPage: p.perPage,
+		Data:    history,
+	}
+
+	c.JSON(http.StatusOK, profile)
+}
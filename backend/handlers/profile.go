@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"wira-dashboard/models"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Profile field limits, in characters
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 500
+)
+
+// avatarTypes maps the image types accepted as avatars to file extensions
+var avatarTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// avatarMaxBytes is the largest avatar upload accepted, read from
+// AVATAR_MAX_BYTES
+func avatarMaxBytes() int64 {
+	return int64(utils.GetEnvInt("AVATAR_MAX_BYTES", 2<<20))
+}
+
+// loadProfile returns the profile the user sees of themselves
+func (h *AuthHandler) loadProfile(userID int) (models.UserProfile, error) {
+	var p models.UserProfile
+	var avatarKey *string
+	err := h.db.QueryRow(`
+		SELECT u.id, u.username, u.email, u.email_verified,
+			(SELECT t.email FROM email_verification_tokens t
+				WHERE t.user_id = u.id AND t.purpose = $2 AND t.expires_at > NOW()),
+			u.display_name, u.bio, u.avatar_key, u.role, COALESCE(u.two_factor_enabled, false), u.created_at
+		FROM users u WHERE u.id = $1`, userID, emailTokenChange).Scan(&p.ID, &p.Username, &p.Email,
+		&p.EmailVerified, &p.PendingEmail, &p.DisplayName, &p.Bio, &avatarKey, &p.Role,
+		&p.TwoFactorEnabled, &p.CreatedAt)
+	if err != nil {
+		return p, err
+	}
+	if avatarKey != nil {
+		url := h.blobs.URL(*avatarKey)
+		p.AvatarURL = &url
+	}
+	return p, nil
+}
+
+// cleanProfileText trims s and checks it fits in max characters without
+// control characters (other than newlines when multiline). Empty text clears
+// the field, returned as nil.
+func cleanProfileText(s string, max int, multiline bool) (*string, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, true
+	}
+	if !utf8.ValidString(s) || utf8.RuneCountInString(s) > max {
+		return nil, false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) && !(multiline && (r == '\n' || r == '\r')) {
+			return nil, false
+		}
+	}
+	return &s, true
+}
+
+// UpdateProfile changes the user's display name, bio and avatar. It takes
+// JSON, or multipart/form-data to upload an avatar in the "avatar" field.
+// Fields that are left out stay as they are; empty text clears a field and
+// remove_avatar removes the avatar.
+func (h *AuthHandler) UpdateProfile(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	// Leave room for the other form fields around the avatar
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, avatarMaxBytes()+64<<10)
+
+	var req struct {
+		DisplayName  *string `json:"display_name" form:"display_name"`
+		Bio          *string `json:"bio" form:"bio"`
+		RemoveAvatar bool    `json:"remove_avatar" form:"remove_avatar"`
+	}
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	fields := gin.H{}
+	var displayName, bio *string
+	if req.DisplayName != nil {
+		var ok bool
+		if displayName, ok = cleanProfileText(*req.DisplayName, maxDisplayNameLength, false); !ok {
+			fields["display_name"] = fmt.Sprintf("Must be at most %d characters on one line", maxDisplayNameLength)
+		}
+	}
+	if req.Bio != nil {
+		var ok bool
+		if bio, ok = cleanProfileText(*req.Bio, maxBioLength, true); !ok {
+			fields["bio"] = fmt.Sprintf("Must be at most %d characters", maxBioLength)
+		}
+	}
+
+	var avatar []byte
+	var avatarType string
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		if file, err := c.FormFile("avatar"); err == nil {
+			if file.Size > avatarMaxBytes() {
+				fields["avatar"] = fmt.Sprintf("Must be at most %d bytes", avatarMaxBytes())
+			} else if f, err := file.Open(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read avatar"})
+				return
+			} else {
+				avatar, err = io.ReadAll(f)
+				f.Close()
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read avatar"})
+					return
+				}
+				avatarType = http.DetectContentType(avatar)
+				if _, ok := avatarTypes[avatarType]; !ok {
+					fields["avatar"] = "Must be a PNG, JPEG, GIF or WebP image"
+				}
+			}
+		} else if err != http.ErrMissingFile {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if len(fields) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid profile", "fields": fields})
+		return
+	}
+
+	// Store the new avatar before pointing the user at it
+	var newAvatarKey *string
+	if avatar != nil {
+		token, err := utils.GenerateEmailToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+			return
+		}
+		key := fmt.Sprintf("avatars/%d-%s%s", userID, token[:16], avatarTypes[avatarType])
+		if err := h.blobs.Put(key, avatarType, avatar); err != nil {
+			log.Printf("Error storing avatar: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+			return
+		}
+		newAvatarKey = &key
+	}
+	changeAvatar := newAvatarKey != nil || req.RemoveAvatar
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var oldAvatarKey *string
+	err = tx.QueryRow("SELECT avatar_key FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&oldAvatarKey)
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE users SET
+				display_name = CASE WHEN $2 THEN $3 ELSE display_name END,
+				bio = CASE WHEN $4 THEN $5 ELSE bio END,
+				avatar_key = CASE WHEN $6 THEN $7 ELSE avatar_key END,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1`,
+			userID, req.DisplayName != nil, displayName, req.Bio != nil, bio, changeAvatar, newAvatarKey)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error updating profile: %v", err)
+		if newAvatarKey != nil {
+			h.deleteBlob(*newAvatarKey)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+	if changeAvatar && oldAvatarKey != nil {
+		h.deleteBlob(*oldAvatarKey)
+	}
+
+	h.LogUserActivity(userID, "profile_update", "Profile updated", c)
+
+	profile, err := h.loadProfile(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user profile"})
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// deleteBlob removes a blob that is no longer referenced. Failures are
+// logged; the blob is only left behind.
+func (h *AuthHandler) deleteBlob(key string) {
+	if err := h.blobs.Delete(key); err != nil {
+		log.Printf("Error deleting blob %s: %v", key, err)
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pagination holds the page and per_page query parameters of a list endpoint
+type pagination struct {
+	page, perPage int
+}
+
+// offset is the number of rows before the requested page
+func (p pagination) offset() int {
+	return (p.page - 1) * p.perPage
+}
+
+// parsePagination reads page and per_page from the query string, responding
+// with 400 if either is not a number. A page below 1 becomes 1 and a per_page
+// outside 1-100 becomes defaultPerPage.
+func parsePagination(c *gin.Context, defaultPerPage int) (pagination, bool) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page parameter"})
+		return pagination{}, false
+	}
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultPerPage)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid per_page parameter"})
+		return pagination{}, false
+	}
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = defaultPerPage
+	}
+	return pagination{page: page, perPage: perPage}, true
+}
+
+// parseTimeRange reads the optional from and to (RFC 3339) query parameters,
+// responding with 400 if one is malformed
+func parseTimeRange(c *gin.Context) (from, to *time.Time, ok bool) {
+	for name, target := range map[string]**time.Time{"from": &from, "to": &to} {
+		if v := c.Query(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + " parameter"})
+				return nil, nil, false
+			}
+			*target = &t
+		}
+	}
+	return from, to, true
+}
@@ -22,29 +22,11 @@ func (h *Handler) GetRankings(c *gin.Context) {
 	// Log request
 	log.Printf("Received rankings request from: %s with query params: %v", c.Request.RemoteAddr, c.Request.URL.Query())
 
-	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
-	if err != nil {
-		log.Printf("Error parsing page parameter: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page parameter"})
-		return
-	}
-
-	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", "20"))
-	if err != nil {
-		log.Printf("Error parsing per_page parameter: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid per_page parameter"})
+	p, ok := parsePagination(c, 20)
+	if !ok {
 		return
 	}
 
-	if page < 1 {
-		page = 1
-	}
-	if perPage < 1 || perPage > 100 {
-		perPage = 20
-	}
-
-	offset := (page - 1) * perPage
-
 	// Get class_id from query, default to 0 (all classes)
 	classIDStr := c.DefaultQuery("class_id", "0")
 	log.Printf("Raw class_id parameter: %s", classIDStr)
@@ -61,7 +43,7 @@ func (h *Handler) GetRankings(c *gin.Context) {
 	}
 
 	// Log query parameters
-	log.Printf("Processed query params - page: %d, perPage: %d, classID: %d", page, perPage, classID)
+	log.Printf("Processed query params - page: %d, perPage: %d, classID: %d", p.page, p.perPage, classID)
 
 	var rows *sql.Rows
 	var total int
@@ -74,6 +56,8 @@ func (h *Handler) GetRankings(c *gin.Context) {
 				JOIN characters c ON a.acc_id = c.acc_id
 				JOIN scores s ON c.char_id = s.char_id
 				WHERE c.class_id = $1
+					AND s.voided_at IS NULL
+					AND (a.banned_at IS NULL OR a.banned_until <= NOW())
 			) AS unique_users`, classID).Scan(&total)
 
 		if err != nil {
@@ -93,12 +77,14 @@ func (h *Handler) GetRankings(c *gin.Context) {
 				JOIN characters c ON a.acc_id = c.acc_id
 				JOIN scores s ON c.char_id = s.char_id
 				WHERE c.class_id = $1
+					AND s.voided_at IS NULL
+					AND (a.banned_at IS NULL OR a.banned_until <= NOW())
 				GROUP BY a.username, c.class_id
 			)
 			SELECT username, class_id, highest_score, rank
 			FROM RankedScores
 			ORDER BY rank
-			LIMIT $2 OFFSET $3`, classID, perPage, offset)
+			LIMIT $2 OFFSET $3`, classID, p.perPage, p.offset())
 	} else {
 		err = h.db.QueryRow(`
 			SELECT COUNT(*) FROM (
@@ -106,6 +92,8 @@ func (h *Handler) GetRankings(c *gin.Context) {
 				FROM accounts a
 				JOIN characters c ON a.acc_id = c.acc_id
 				JOIN scores s ON c.char_id = s.char_id
+				WHERE s.voided_at IS NULL
+					AND (a.banned_at IS NULL OR a.banned_until <= NOW())
 			) AS unique_users`).Scan(&total)
 
 		if err != nil {
@@ -124,12 +112,14 @@ func (h *Handler) GetRankings(c *gin.Context) {
 				FROM accounts a
 				JOIN characters c ON a.acc_id = c.acc_id
 				JOIN scores s ON c.char_id = s.char_id
+				WHERE s.voided_at IS NULL
+					AND (a.banned_at IS NULL OR a.banned_until <= NOW())
 				GROUP BY a.username, c.class_id
 			)
 			SELECT username, class_id, highest_score, rank
 			FROM RankedScores
 			ORDER BY highest_score DESC
-			LIMIT $1 OFFSET $2`, perPage, offset)
+			LIMIT $1 OFFSET $2`, p.perPage, p.offset())
 	}
 
 	if err != nil {
@@ -155,8 +145,8 @@ func (h *Handler) GetRankings(c *gin.Context) {
 
 	c.JSON(http.StatusOK, models.PaginatedResponse{
 		Total:   total,
-		Page:    page,
-		PerPage: perPage,
+		Page:    p.page,
+		PerPage: p.perPage,
 		Data:    rankings,
 	})
 }
@@ -169,29 +159,11 @@ func (h *Handler) SearchRankings(c *gin.Context) {
 		return
 	}
 
-	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
-	if err != nil {
-		log.Printf("Error parsing page parameter: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page parameter"})
-		return
-	}
-
-	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", "20"))
-	if err != nil {
-		log.Printf("Error parsing per_page parameter: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid per_page parameter"})
+	p, ok := parsePagination(c, 20)
+	if !ok {
 		return
 	}
 
-	if page < 1 {
-		page = 1
-	}
-	if perPage < 1 || perPage > 100 {
-		perPage = 20
-	}
-
-	offset := (page - 1) * perPage
-
 	// Get class_id from query, default to 0 (all classes)
 	classIDStr := c.DefaultQuery("class_id", "0")
 	log.Printf("Raw class_id parameter: %s", classIDStr)
@@ -208,7 +180,7 @@ func (h *Handler) SearchRankings(c *gin.Context) {
 	}
 
 	// Log query parameters
-	log.Printf("Processed query params - page: %d, perPage: %d, classID: %d, username: %s", page, perPage, classID, username)
+	log.Printf("Processed query params - page: %d, perPage: %d, classID: %d, username: %s", p.page, p.perPage, classID, username)
 
 	query := `
 		WITH RankedScores AS (
@@ -221,6 +193,8 @@ func (h *Handler) SearchRankings(c *gin.Context) {
 			JOIN characters c ON a.acc_id = c.acc_id
 			JOIN scores s ON c.char_id = s.char_id
 			WHERE LOWER(a.username) LIKE LOWER($1)
+				AND s.voided_at IS NULL
+				AND (a.banned_at IS NULL OR a.banned_until <= NOW())
 			GROUP BY a.username, c.class_id
 		)
 		SELECT username, class_id, highest_score, rank
@@ -238,6 +212,8 @@ func (h *Handler) SearchRankings(c *gin.Context) {
 				JOIN characters c ON a.acc_id = c.acc_id
 				JOIN scores s ON c.char_id = s.char_id
 				WHERE LOWER(a.username) LIKE LOWER($1) AND c.class_id = $2
+					AND s.voided_at IS NULL
+					AND (a.banned_at IS NULL OR a.banned_until <= NOW())
 			) AS unique_users`, "%"+username+"%", classID).Scan(&total)
 		
 		if err != nil {
@@ -246,7 +222,7 @@ func (h *Handler) SearchRankings(c *gin.Context) {
 			return
 		}
 
-		rows, err = h.db.Query(query + ` WHERE class_id = $2 ORDER BY rank LIMIT $3 OFFSET $4`, "%"+username+"%", classID, perPage, offset)
+		rows, err = h.db.Query(query + ` WHERE class_id = $2 ORDER BY rank LIMIT $3 OFFSET $4`, "%"+username+"%", classID, p.perPage, p.offset())
 	} else {
 		err = h.db.QueryRow(`
 			SELECT COUNT(*) FROM (
@@ -255,6 +231,8 @@ func (h *Handler) SearchRankings(c *gin.Context) {
 				JOIN characters c ON a.acc_id = c.acc_id
 				JOIN scores s ON c.char_id = s.char_id
 				WHERE LOWER(a.username) LIKE LOWER($1)
+					AND s.voided_at IS NULL
+					AND (a.banned_at IS NULL OR a.banned_until <= NOW())
 			) AS unique_users`, "%"+username+"%").Scan(&total)
 		
 		if err != nil {
@@ -263,7 +241,7 @@ func (h *Handler) SearchRankings(c *gin.Context) {
 			return
 		}
 
-		rows, err = h.db.Query(query + ` ORDER BY rank LIMIT $2 OFFSET $3`, "%"+username+"%", perPage, offset)
+		rows, err = h.db.Query(query + ` ORDER BY rank LIMIT $2 OFFSET $3`, "%"+username+"%", p.perPage, p.offset())
 	}
 
 	if err != nil {
@@ -286,8 +264,8 @@ func (h *Handler) SearchRankings(c *gin.Context) {
 
 	c.JSON(http.StatusOK, models.PaginatedResponse{
 		Total:   total,
-		Page:    page,
-		PerPage: perPage,
+		Page:    p.page,
+		PerPage: p.perPage,
 		Data:    rankings,
 	})
 }
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"wira-dashboard/models"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegenerateRecoveryCodes replaces the user's 2FA recovery codes. A current
+// TOTP code is required so a stolen access token cannot mint new codes.
+func (h *AuthHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	var req models.Enable2FARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetInt("user_id")
+
+	var secret string
+	var enabled bool
+	err := h.db.QueryRow("SELECT COALESCE(two_factor_secret, ''), two_factor_enabled FROM users WHERE id = $1", userID).Scan(&secret, &enabled)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "2FA is not enabled"})
+		return
+	}
+
+	valid, err := h.verifyTOTP(h.db, userID, secret, req.TOTPCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 2FA code"})
+		return
+	}
+
+	codes, err := h.generateRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating recovery codes"})
+		return
+	}
+
+	h.LogUserActivity(userID, "recovery_codes_generated", "2FA recovery codes regenerated", c)
+	recordAudit(h.db, c, "recovery_codes_generated", "user", userID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// generateRecoveryCodes replaces any existing recovery codes of the user with
+// a new set and returns the plaintext codes, which are only shown once
+func (h *AuthHandler) generateRecoveryCodes(userID int) ([]string, error) {
+	codes, err := utils.GenerateRecoveryCodes(utils.RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM two_factor_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec(`
+			INSERT INTO two_factor_recovery_codes (user_id, code_hash)
+			VALUES ($1, $2)`,
+			userID, utils.HashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// useRecoveryCode consumes a recovery code of the user within tx. It returns
+// false if the code is unknown or was already used.
+func useRecoveryCode(tx *sql.Tx, userID int, code string) (bool, error) {
+	result, err := tx.Exec(`
+		UPDATE two_factor_recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, utils.HashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// logRecoveryCodeUse records that a recovery code was used and how many are
+// left
+func (h *AuthHandler) logRecoveryCodeUse(c *gin.Context, userID int) {
+	remaining, err := h.remainingRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("Error counting recovery codes: %v", err)
+	}
+	h.LogUserActivity(userID, "recovery_code_used",
+		fmt.Sprintf("2FA recovery code used, %d remaining", remaining), c)
+}
+
+// remainingRecoveryCodes counts the unused recovery codes of the user
+func (h *AuthHandler) remainingRecoveryCodes(userID int) (int, error) {
+	var remaining int
+	err := h.db.QueryRow(`
+		SELECT COUNT(*) FROM two_factor_recovery_codes
+		WHERE user_id = $1 AND used_at IS NULL`, userID).Scan(&remaining)
+	return remaining, err
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// loadRole returns the user's role and the permissions it grants
+func (h *AuthHandler) loadRole(userID int) (string, []string, error) {
+	var role string
+	var permissions []string
+	err := h.db.QueryRow(`
+		SELECT u.role, COALESCE(ARRAY_AGG(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM users u
+		LEFT JOIN role_permissions rp ON rp.role = u.role
+		WHERE u.id = $1
+		GROUP BY u.role`, userID).Scan(&role, pq.Array(&permissions))
+	if err != nil {
+		return "", nil, err
+	}
+	return role, permissions, nil
+}
+
+// GetRoles lists the roles and the permissions each grants
+func (h *AuthHandler) GetRoles(c *gin.Context) {
+	rows, err := h.db.Query(`
+		SELECT r.name, r.description, COALESCE(ARRAY_AGG(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role = r.name
+		GROUP BY r.name, r.description, r.rank
+		ORDER BY r.rank`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	type roleInfo struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	roles := []roleInfo{}
+	for rows.Next() {
+		var role roleInfo
+		if err := rows.Scan(&role.Name, &role.Description, pq.Array(&role.Permissions)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		roles = append(roles, role)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+// SetUserRole changes a user's role. Like other account actions it only
+// applies to users ranked below the caller, and the caller cannot grant a role
+// ranked above their own. The user's access tokens are revoked so the next
+// refresh issues one carrying the new role.
+func (h *AuthHandler) SetUserRole(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if userID == c.GetInt("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
+	}
+
+	if _, _, _, ok := h.adminManageableUser(c); !ok {
+		return
+	}
+
+	var roleRank sql.NullInt64
+	var actorRank int
+	err = h.db.QueryRow(`
+		SELECT
+			(SELECT rank FROM roles WHERE name = $1),
+			COALESCE((SELECT r.rank FROM users u JOIN roles r ON r.name = u.role WHERE u.id = $2), -1)`,
+		req.Role, c.GetInt("user_id")).Scan(&roleRank, &actorRank)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !roleRank.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+		return
+	}
+	if int(roleRank.Int64) > actorRank {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot assign a role higher than your own"})
+		return
+	}
+
+	var previous string
+	err = h.db.QueryRow(`
+		UPDATE users u SET role = $1, updated_at = CURRENT_TIMESTAMP
+		FROM users old
+		WHERE u.id = old.id AND u.id = $2
+		RETURNING old.role`, req.Role, userID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing role: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if err := h.revokeAccessTokens(userID); err != nil {
+		log.Printf("Error revoking access tokens after role change: %v", err)
+	}
+
+	h.LogUserActivity(userID, "role_change", fmt.Sprintf("Role changed from %s to %s by user %d", previous, req.Role, c.GetInt("user_id")), c)
+	recordAudit(h.db, c, "role_change", "user", userID, map[string]interface{}{"from": previous, "to": req.Role})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Role updated",
+		"role":    req.Role,
+	})
+}
+
+// revokeAccessTokens adds every outstanding access token of a user to the
+// denylist while keeping their sessions, so clients refresh to get new claims
+func (h *AuthHandler) revokeAccessTokens(userID int) error {
+	_, err := h.db.Exec(`
+		INSERT INTO revoked_tokens (jti, user_id, expires_at)
+		SELECT jti, user_id, expires_at
+		FROM access_tokens
+		WHERE user_id = $1 AND expires_at > NOW()
+		ON CONFLICT (jti) DO NOTHING`, userID)
+	return err
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"wira-dashboard/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Security event types
+const (
+	// securityEventUnknownUser is a login attempt with a username that does
+	// not exist
+	securityEventUnknownUser = "login_unknown_user"
+	// securityEventLockoutCleared marks an admin unlocking an IP; earlier
+	// unknown-username attempts from it no longer count towards a lockout
+	securityEventLockoutCleared = "lockout_cleared"
+)
+
+// insertSecurityEvent stores a security event. Failures are logged but do not
+// fail the request.
+func insertSecurityEvent(database *sql.DB, eventType, username, ip, userAgent string) {
+	_, err := database.Exec(`
+		INSERT INTO security_events (event_type, username, ip_address, user_agent)
+		VALUES ($1, $2, $3, $4)`,
+		eventType, username, ip, userAgent)
+	if err != nil {
+		log.Printf("Error recording security event %s: %v", eventType, err)
+	}
+}
+
+// recordSecurityEvent stores a security event that belongs to no user, with
+// the client's IP and user agent
+func recordSecurityEvent(database *sql.DB, c *gin.Context, eventType, username string) {
+	insertSecurityEvent(database, eventType, username, c.ClientIP(), c.Request.UserAgent())
+}
+
+// countUnknownUserAttempts returns how many unknown-username logins came from
+// the IP within the lockout window, and when the last one was. Attempts before
+// an admin last cleared the IP are not counted.
+func (h *AuthHandler) countUnknownUserAttempts(q queryer, ip string) (int, time.Time, error) {
+	var count int
+	var last time.Time
+	err := q.QueryRow(`
+		SELECT COUNT(*), COALESCE(MAX(created_at), 'epoch')
+		FROM security_events
+		WHERE ip_address = $1
+			AND event_type = $2
+			AND created_at > GREATEST(
+				NOW() - $3 * INTERVAL '1 second',
+				(SELECT MAX(created_at) FROM security_events WHERE ip_address = $1 AND event_type = $4))`,
+		ip, securityEventUnknownUser, int64(h.lockout.Window.Seconds()), securityEventLockoutCleared).Scan(&count, &last)
+	return count, last, err
+}
+
+// GetSecurityEvents lists security events, newest first, filtered by
+// event_type, username, ip_address and a from/to date range (RFC 3339)
+func (h *AuthHandler) GetSecurityEvents(c *gin.Context) {
+	p, ok := parsePagination(c, 50)
+	if !ok {
+		return
+	}
+
+	from, to, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+
+	filter := `
+		WHERE ($1 = '' OR event_type = $1)
+			AND ($2 = '' OR username = $2)
+			AND ($3 = '' OR ip_address = $3)
+			AND ($4::timestamptz IS NULL OR created_at >= $4)
+			AND ($5::timestamptz IS NULL OR created_at < $5)`
+	args := []interface{}{c.Query("event_type"), c.Query("username"), c.Query("ip_address"), from, to}
+
+	var total int
+	if err := h.db.QueryRow(`SELECT COUNT(*) FROM security_events`+filter, args...).Scan(&total); err != nil {
+		log.Printf("Error counting security events: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, event_type, username, ip_address, user_agent, created_at
+		FROM security_events`+filter+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT $6 OFFSET $7`, append(args, p.perPage, p.offset())...)
+	if err != nil {
+		log.Printf("Error fetching security events: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	events := []models.SecurityEvent{}
+	for rows.Next() {
+		var e models.SecurityEvent
+		if err := rows.Scan(&e.ID, &e.EventType, &e.Username, &e.IPAddress, &e.UserAgent, &e.CreatedAt); err != nil {
+			log.Printf("Error scanning security event: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		events = append(events, e)
+	}
+
+	c.JSON(http.StatusOK, models.PaginatedResponse{
+		Total:   total,
+		Page:    p.page,
+		PerPage: p.perPage,
+		Data:    events,
+	})
+}
+
+// GetUnknownUserReport summarises unknown-username login attempts over the
+// last hours (default 24): the total and the top IPs and usernames
+func (h *AuthHandler) GetUnknownUserReport(c *gin.Context) {
+	hours, err := strconv.Atoi(c.DefaultQuery("hours", "24"))
+	if err != nil || hours < 1 || hours > 24*90 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hours parameter"})
+		return
+	}
+
+	type count struct {
+		Value    string    `json:"value"`
+		Attempts int       `json:"attempts"`
+		LastSeen time.Time `json:"last_seen"`
+	}
+	top := func(column string) ([]count, error) {
+		rows, err := h.db.Query(`
+			SELECT `+column+`, COUNT(*), MAX(created_at)
+			FROM security_events
+			WHERE event_type = $1 AND created_at > NOW() - $2 * INTERVAL '1 hour'
+			GROUP BY `+column+`
+			ORDER BY COUNT(*) DESC, MAX(created_at) DESC
+			LIMIT 10`, securityEventUnknownUser, hours)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		counts := []count{}
+		for rows.Next() {
+			var ct count
+			if err := rows.Scan(&ct.Value, &ct.Attempts, &ct.LastSeen); err != nil {
+				return nil, err
+			}
+			counts = append(counts, ct)
+		}
+		return counts, rows.Err()
+	}
+
+	var total int
+	if err := h.db.QueryRow(`
+		SELECT COUNT(*) FROM security_events
+		WHERE event_type = $1 AND created_at > NOW() - $2 * INTERVAL '1 hour'`,
+		securityEventUnknownUser, hours).Scan(&total); err != nil {
+		log.Printf("Error counting unknown-user attempts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	topIPs, err := top("ip_address")
+	if err != nil {
+		log.Printf("Error fetching unknown-user attempts by IP: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	topUsernames, err := top("username")
+	if err != nil {
+		log.Printf("Error fetching unknown-user attempts by username: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"hours":         hours,
+		"total":         total,
+		"top_ips":       topIPs,
+		"top_usernames": topUsernames,
+	})
+}
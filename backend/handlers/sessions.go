@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"wira-dashboard/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetSessions lists the active sessions (refresh tokens) of the user
+func (h *AuthHandler) GetSessions(c *gin.Context) {
+	sessions, err := h.loadSessions(c.GetInt("user_id"), h.currentSessionID(c))
+	if err != nil {
+		log.Printf("Error fetching sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// loadSessions returns the user's active sessions, most recently used first,
+// marking currentSessionID as the current one
+func (h *AuthHandler) loadSessions(userID, currentSessionID int) ([]models.Session, error) {
+	rows, err := h.db.Query(`
+		SELECT id, COALESCE(user_agent, ''), COALESCE(ip_address, ''),
+			created_at, COALESCE(last_used_at, created_at), expires_at
+		FROM refresh_tokens
+		WHERE user_id = $1 AND expires_at > NOW()
+		ORDER BY COALESCE(last_used_at, created_at) DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		if err := rows.Scan(&session.ID, &session.UserAgent, &session.IPAddress,
+			&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		session.Current = session.ID == currentSessionID
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession revokes one of the user's sessions along with the access
+// tokens issued for it
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	sessionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	err = h.revokeSession(userID, sessionID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "session_revoked", "Session revoked", c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
+}
+
+// currentSessionID returns the session the request's access token was
+// issued for, or 0 if it is unknown
+func (h *AuthHandler) currentSessionID(c *gin.Context) int {
+	var sessionID sql.NullInt64
+	err := h.db.QueryRow("SELECT session_id FROM access_tokens WHERE jti = $1", c.GetString("jti")).Scan(&sessionID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error looking up current session: %v", err)
+	}
+	return int(sessionID.Int64)
+}
+
+// revokeSession deletes a refresh token of the user and adds the access
+// tokens issued for it to the denylist. It returns sql.ErrNoRows if the
+// session does not belong to the user.
+func (h *AuthHandler) revokeSession(userID, sessionID int) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO revoked_tokens (jti, user_id, expires_at)
+		SELECT jti, user_id, expires_at
+		FROM access_tokens
+		WHERE session_id = $1 AND user_id = $2 AND expires_at > NOW()
+		ON CONFLICT (jti) DO NOTHING`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("DELETE FROM refresh_tokens WHERE id = $1 AND user_id = $2", sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
@@ -23,7 +23,10 @@ func (h *Handler) GetClassStats(c *gin.Context) {
 			MAX(s.reward_score) as highest_score,
 			MIN(s.reward_score) as lowest_score
 		FROM characters c
+		JOIN accounts a ON a.acc_id = c.acc_id
 		JOIN scores s ON c.char_id = s.char_id
+		WHERE s.voided_at IS NULL
+			AND (a.banned_at IS NULL OR a.banned_until <= NOW())
 		GROUP BY c.class_id
 		ORDER BY c.class_id`
 
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"wira-dashboard/models"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// reauthUser is what re-authentication needs to know about the signed-in user
+type reauthUser struct {
+	secret           sql.NullString
+	twoFactorEnabled bool
+	hasWebAuthn      bool
+	attempt          *loginAttempt // counted as failed until succeeded is called
+}
+
+// secondFactorMethods lists the second factors a user can complete a login or
+// re-authentication with
+func secondFactorMethods(totp, webAuthn bool) []string {
+	methods := []string{}
+	if totp {
+		methods = append(methods, "totp")
+	}
+	if webAuthn {
+		methods = append(methods, "webauthn")
+	}
+	return methods
+}
+
+// checkReauthPassword verifies the signed-in user's password, honouring login
+// lockouts. It responds and returns false if the password is not accepted.
+// The attempt stays counted as failed until the caller marks it succeeded.
+func (h *AuthHandler) checkReauthPassword(c *gin.Context, password string) (*reauthUser, bool) {
+	userID := c.GetInt("user_id")
+	username := c.GetString("username")
+
+	attempt, wait, err := h.beginAttempt(username, c.ClientIP(), "password")
+	if err != nil {
+		log.Printf("Error checking lockout: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	if wait > 0 {
+		rejectLockedOut(c, wait)
+		return nil, false
+	}
+
+	user := reauthUser{attempt: attempt}
+	var passwordHash string
+	err = h.db.QueryRow(`
+		SELECT password_hash, two_factor_secret, two_factor_enabled
+		FROM users WHERE id = $1`,
+		userID).Scan(&passwordHash, &user.secret, &user.twoFactorEnabled)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+
+	if !utils.CheckPassword(password, passwordHash) {
+		h.LogUserActivity(userID, "reauth_failed", "Failed re-authentication: incorrect password", c)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return nil, false
+	}
+
+	if h.webauthn != nil {
+		user.hasWebAuthn, err = h.hasWebAuthnCredentials(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return nil, false
+		}
+	}
+	return &user, true
+}
+
+// markReauthenticated records that the current access token was just
+// re-authenticated, so it can be used for sensitive changes for a while
+func (h *AuthHandler) markReauthenticated(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	_, err := h.db.Exec(`
+		UPDATE access_tokens
+		SET reauthenticated_at = CURRENT_TIMESTAMP
+		WHERE jti = $1 AND user_id = $2`,
+		c.GetString("jti"), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "reauth", "Re-authenticated for a sensitive change", c)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Re-authenticated successfully",
+		"expires_in": int(utils.ReauthWindow().Seconds()),
+	})
+}
+
+// Reauthenticate verifies the current password, plus a TOTP code when 2FA is
+// enabled, and marks the current access token as recently re-authenticated so
+// it can be used for sensitive account changes. Users with a security key can
+// use BeginWebAuthnReauth instead of a TOTP code.
+func (h *AuthHandler) Reauthenticate(c *gin.Context) {
+	var req models.ReauthenticateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	user, ok := h.checkReauthPassword(c, req.Password)
+	if !ok {
+		return
+	}
+
+	if req.TOTPCode != "" && user.twoFactorEnabled {
+		valid, err := h.verifyTOTP(h.db, userID, user.secret.String, req.TOTPCode)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !valid {
+			h.LogUserActivity(userID, "reauth_failed", "Failed re-authentication: invalid 2FA code", c)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid 2FA code"})
+			return
+		}
+	} else if user.twoFactorEnabled || user.hasWebAuthn {
+		// The password was right; the second factor is still to come
+		user.attempt.succeeded()
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":        "2FA required",
+			"requires_2fa": true,
+			"methods":      secondFactorMethods(user.twoFactorEnabled, user.hasWebAuthn),
+		})
+		return
+	}
+
+	user.attempt.succeeded()
+	h.markReauthenticated(c)
+}
+
+// BeginWebAuthnReauth verifies the current password and starts a WebAuthn
+// assertion that completes the re-authentication in FinishWebAuthnReauth
+func (h *AuthHandler) BeginWebAuthnReauth(c *gin.Context) {
+	if !h.requireWebAuthn(c) {
+		return
+	}
+
+	var req struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	reauth, ok := h.checkReauthPassword(c, req.Password)
+	if !ok {
+		return
+	}
+	// The security key assertion counts as its own attempt
+	reauth.attempt.succeeded()
+
+	user, err := h.loadWebAuthnUser(userID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if len(user.credentials) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No security keys registered"})
+		return
+	}
+	assertion, session, err := h.webauthn.BeginLogin(user)
+	if err != nil {
+		log.Printf("Error beginning WebAuthn re-authentication: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting re-authentication"})
+		return
+	}
+
+	// Tie the ceremony to this access token so it cannot re-authenticate another
+	sessionID, err := h.saveWebAuthnSession("reauth", userID, c.GetString("jti"), session)
+	if err != nil {
+		log.Printf("Error saving WebAuthn session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_id": sessionID,
+		"options":    assertion,
+	})
+}
+
+// FinishWebAuthnReauth verifies the assertion for the ceremony in
+// ?session_id= and marks the current access token as re-authenticated
+func (h *AuthHandler) FinishWebAuthnReauth(c *gin.Context) {
+	if !h.requireWebAuthn(c) {
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	session, sessionUserID, sessionJTI, err := h.takeWebAuthnSession(c.Query("session_id"), "reauth")
+	if err != nil || sessionUserID != userID || sessionJTI != c.GetString("jti") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired WebAuthn session"})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid assertion"})
+		return
+	}
+
+	user, err := h.loadWebAuthnUser(userID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	attempt, wait, err := h.beginAttempt(user.username, c.ClientIP(), "webauthn")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if wait > 0 {
+		rejectLockedOut(c, wait)
+		return
+	}
+
+	credential, err := h.webauthn.ValidateLogin(user, *session, parsed)
+	if err != nil {
+		log.Printf("WebAuthn re-authentication failed: %v", err)
+		h.LogUserActivity(userID, "reauth_failed", "Failed re-authentication: invalid security key assertion", c)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Security key verification failed"})
+		return
+	}
+	if !h.updateWebAuthnCredential(c, user, credential, "reauth_failed") {
+		return
+	}
+
+	attempt.succeeded()
+	h.markReauthenticated(c)
+}
+
+// ChangeEmail starts changing the user's email address by sending a
+// confirmation link to the new address
+func (h *AuthHandler) ChangeEmail(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+
+	var exists bool
+	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 AND id <> $2)", email, userID).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
+		return
+	}
+
+	var username, currentEmail string
+	err = h.db.QueryRow("SELECT username, email FROM users WHERE id = $1", userID).Scan(&username, &currentEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if strings.EqualFold(email, currentEmail) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "That is already your email address"})
+		return
+	}
+
+	// The email only changes once the new address is confirmed
+	if err := h.sendEmailChangeConfirmation(userID, username, currentEmail, email); err != nil {
+		log.Printf("Error creating email change confirmation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update email"})
+		return
+	}
+
+	h.LogUserActivity(userID, "email_change_requested", "Email change requested, waiting for confirmation", c)
+	recordAudit(h.db, c, "email_change_requested", "user", userID, nil)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":       "Check your new email address to confirm the change",
+		"pending_email": email,
+	})
+}
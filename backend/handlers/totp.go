@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"database/sql"
+	"wira-dashboard/utils"
+)
+
+// queryer runs statements on the database or inside a transaction
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// verifyTOTP checks a TOTP code against the user's stored (encrypted) secret
+// and records when the accepted time-step started through q, so the same code
+// (or an older one) cannot be used again
+func (h *AuthHandler) verifyTOTP(q queryer, userID int, storedSecret, code string) (bool, error) {
+	secret, err := h.secrets.Decrypt(storedSecret, utils.TOTPSecretAAD(userID))
+	if err != nil {
+		return false, err
+	}
+
+	var lastUsed int64
+	err = q.QueryRow("SELECT COALESCE(two_factor_last_used, 0) FROM users WHERE id = $1", userID).Scan(&lastUsed)
+	if err != nil {
+		return false, err
+	}
+
+	used, ok := h.totp.ValidateCode(secret, code, lastUsed)
+	if !ok {
+		return false, nil
+	}
+
+	// Only one request can move the time forward, so concurrent replays fail
+	result, err := q.Exec(`
+		UPDATE users
+		SET two_factor_last_used = $1
+		WHERE id = $2 AND COALESCE(two_factor_last_used, 0) < $1`,
+		used, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// encryptTOTPSecret encrypts a TOTP secret for storage in users.two_factor_secret
+func (h *AuthHandler) encryptTOTPSecret(userID int, secret string) (string, error) {
+	return h.secrets.Encrypt(secret, utils.TOTPSecretAAD(userID))
+}
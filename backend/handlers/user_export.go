@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+	"wira-dashboard/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// ExportUserData downloads everything stored about the user as a JSON
+// archive: profile, activities, sessions, security keys, linked game
+// accounts with their characters and scores
+func (h *AuthHandler) ExportUserData(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	fail := func(what string, err error) {
+		log.Printf("Error exporting %s for user %d: %v", what, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export data"})
+	}
+
+	profile, err := h.loadProfile(userID)
+	if err != nil {
+		fail("profile", err)
+		return
+	}
+
+	activities, err := queryAllActivities(h.db, userID, activityFilter{})
+	if err != nil {
+		fail("activities", err)
+		return
+	}
+
+	sessions, err := h.loadSessions(userID, h.currentSessionID(c))
+	if err != nil {
+		fail("sessions", err)
+		return
+	}
+
+	type securityKey struct {
+		Name       string     `json:"name"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+	}
+	securityKeys := []securityKey{}
+	rows, err := h.db.Query(`
+		SELECT name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at`, userID)
+	if err != nil {
+		fail("security keys", err)
+		return
+	}
+	for rows.Next() {
+		var key securityKey
+		if err := rows.Scan(&key.Name, &key.CreatedAt, &key.LastUsedAt); err != nil {
+			rows.Close()
+			fail("security keys", err)
+			return
+		}
+		securityKeys = append(securityKeys, key)
+	}
+	rows.Close()
+
+	links, err := h.loadGameAccountLinks(userID)
+	if err != nil {
+		fail("game accounts", err)
+		return
+	}
+	accIDs := make([]int, len(links))
+	for i, link := range links {
+		accIDs[i] = link.AccID
+	}
+
+	characters, err := loadCharacterSummaries(h.db, accIDs)
+	if err != nil {
+		fail("characters", err)
+		return
+	}
+
+	scores := []models.ScoreEntry{}
+	if len(accIDs) > 0 {
+		rows, err := h.db.Query(`
+			SELECT s.score_id, s.char_id, c.class_id, s.reward_score, s.created_at
+			FROM characters c
+			JOIN scores s ON c.char_id = s.char_id
+			WHERE c.acc_id = ANY($1)
+			ORDER BY s.created_at, s.score_id`, pq.Array(accIDs))
+		if err != nil {
+			fail("scores", err)
+			return
+		}
+		for rows.Next() {
+			var s models.ScoreEntry
+			if err := rows.Scan(&s.ScoreID, &s.CharID, &s.ClassID, &s.RewardScore, &s.CreatedAt); err != nil {
+				rows.Close()
+				fail("scores", err)
+				return
+			}
+			scores = append(scores, s)
+		}
+		rows.Close()
+	}
+
+	h.LogUserActivity(userID, "data_export", "Personal data exported", c)
+
+	filename := "wira-dashboard-export-" + time.Now().UTC().Format("20060102") + ".json"
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"exported_at":   time.Now().UTC(),
+		"profile":       profile,
+		"activities":    activities,
+		"sessions":      sessions,
+		"security_keys": securityKeys,
+		"game_accounts": links,
+		"characters":    characters,
+		"scores":        scores,
+	})
+}
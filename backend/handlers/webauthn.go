@@ -0,0 +1,571 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// webAuthnSessionExpiry is how long a registration or login ceremony may take
+const webAuthnSessionExpiry = 5 * time.Minute
+
+// errLockedOut stops a passwordless login whose user is locked out
+var errLockedOut = errors.New("locked out")
+
+// NewWebAuthn creates the WebAuthn relying party from WEBAUTHN_RP_ID,
+// WEBAUTHN_RP_NAME and WEBAUTHN_RP_ORIGINS (comma-separated). The RP ID and
+// origins default to localhost in development and are required otherwise.
+func NewWebAuthn() (*webauthn.WebAuthn, error) {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	origins := utils.GetEnvList("WEBAUTHN_RP_ORIGINS")
+	if utils.IsDevelopment() {
+		if rpID == "" {
+			rpID = "localhost"
+		}
+		if len(origins) == 0 {
+			origins = []string{"http://localhost:5173", "http://localhost:5180"}
+		}
+	}
+	if rpID == "" || len(origins) == 0 {
+		return nil, fmt.Errorf("WEBAUTHN_RP_ID and WEBAUTHN_RP_ORIGINS are required outside development")
+	}
+	rpName := os.Getenv("WEBAUTHN_RP_NAME")
+	if rpName == "" {
+		rpName = "WIRA Dashboard"
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpName,
+		RPOrigins:     origins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: webAuthnSessionExpiry},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: webAuthnSessionExpiry},
+		},
+	})
+}
+
+// webAuthnUser adapts a dashboard user to the webauthn.User interface
+type webAuthnUser struct {
+	id          int
+	handle      []byte
+	username    string
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte                         { return u.handle }
+func (u *webAuthnUser) WebAuthnName() string                       { return u.username }
+func (u *webAuthnUser) WebAuthnDisplayName() string                { return u.username }
+func (u *webAuthnUser) WebAuthnIcon() string                       { return "" }
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// requireWebAuthn responds with 503 if WebAuthn is not configured
+func (h *AuthHandler) requireWebAuthn(c *gin.Context) bool {
+	if h.webauthn == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "WebAuthn is not configured"})
+		return false
+	}
+	return true
+}
+
+// BeginWebAuthnRegistration starts registering a new passkey or security key
+// for the authenticated user
+func (h *AuthHandler) BeginWebAuthnRegistration(c *gin.Context) {
+	if !h.requireWebAuthn(c) {
+		return
+	}
+	userID := c.GetInt("user_id")
+
+	user, err := h.loadWebAuthnUser(userID, true)
+	if err != nil {
+		log.Printf("Error loading WebAuthn user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, len(user.credentials))
+	for i, credential := range user.credentials {
+		exclusions[i] = credential.Descriptor()
+	}
+
+	// Prefer discoverable credentials so they can be used for passwordless login
+	creation, session, err := h.webauthn.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred))
+	if err != nil {
+		log.Printf("Error beginning WebAuthn registration: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting registration"})
+		return
+	}
+
+	sessionID, err := h.saveWebAuthnSession("registration", userID, "", session)
+	if err != nil {
+		log.Printf("Error saving WebAuthn session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_id": sessionID,
+		"options":    creation,
+	})
+}
+
+// FinishWebAuthnRegistration verifies the authenticator's attestation and
+// stores the new credential. The request body is the credential returned by
+// navigator.credentials.create(); the ceremony is identified by ?session_id=
+// and the credential can be named with ?name=.
+func (h *AuthHandler) FinishWebAuthnRegistration(c *gin.Context) {
+	if !h.requireWebAuthn(c) {
+		return
+	}
+	userID := c.GetInt("user_id")
+
+	session, sessionUserID, _, err := h.takeWebAuthnSession(c.Query("session_id"), "registration")
+	if err != nil || sessionUserID != userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired WebAuthn session"})
+		return
+	}
+
+	user, err := h.loadWebAuthnUser(userID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential"})
+		return
+	}
+	credential, err := h.webauthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		log.Printf("WebAuthn registration failed: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Credential verification failed"})
+		return
+	}
+
+	name := strings.TrimSpace(c.Query("name"))
+	if name == "" {
+		name = "Security key"
+	}
+	if len(name) > 100 {
+		name = name[:100]
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i, transport := range credential.Transport {
+		transports[i] = string(transport)
+	}
+
+	var id int
+	err = h.db.QueryRow(`
+		INSERT INTO webauthn_credentials
+			(user_id, credential_id, public_key, attestation_type, transports, aaguid,
+			 sign_count, backup_eligible, backup_state, name)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id`,
+		userID, credential.ID, credential.PublicKey, credential.AttestationType,
+		strings.Join(transports, ","), credential.Authenticator.AAGUID,
+		int64(credential.Authenticator.SignCount), credential.Flags.BackupEligible,
+		credential.Flags.BackupState, name).Scan(&id)
+	if err != nil {
+		log.Printf("Error storing WebAuthn credential: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.LogUserActivity(userID, "webauthn_registered", fmt.Sprintf("Security key registered: %s", name), c)
+	recordAudit(h.db, c, "webauthn_registered", "user", userID, map[string]interface{}{"credential_id": id, "name": name})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":   id,
+		"name": name,
+	})
+}
+
+// GetWebAuthnCredentials lists the user's registered passkeys and security keys
+func (h *AuthHandler) GetWebAuthnCredentials(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	rows, err := h.db.Query(`
+		SELECT id, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	type credentialInfo struct {
+		ID         int        `json:"id"`
+		Name       string     `json:"name"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+	}
+	credentials := []credentialInfo{}
+	for rows.Next() {
+		var info credentialInfo
+		if err := rows.Scan(&info.ID, &info.Name, &info.CreatedAt, &info.LastUsedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		credentials = append(credentials, info)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"credentials": credentials})
+}
+
+// DeleteWebAuthnCredential removes one of the user's credentials
+func (h *AuthHandler) DeleteWebAuthnCredential(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential ID"})
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Credential not found"})
+		return
+	}
+
+	h.LogUserActivity(userID, "webauthn_removed", "Security key removed", c)
+	recordAudit(h.db, c, "webauthn_removed", "user", userID, map[string]interface{}{"credential_id": id})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Credential removed successfully"})
+}
+
+// BeginWebAuthnLogin starts a WebAuthn assertion. With a challenge_token
+// from Login it is the second factor for that user; without one it starts a
+// passwordless login with a discoverable credential (passkey).
+func (h *AuthHandler) BeginWebAuthnLogin(c *gin.Context) {
+	if !h.requireWebAuthn(c) {
+		return
+	}
+
+	var req struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	var userID int
+	var challengeJTI string
+	var err error
+
+	if req.ChallengeToken != "" {
+		claims, err := utils.ValidateTokenType(req.ChallengeToken, utils.TokenType2FAChallenge)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+			return
+		}
+		userID = int((*claims)["user_id"].(float64))
+		challengeJTI = (*claims)["jti"].(string)
+
+		user, err := h.loadWebAuthnUser(userID, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if len(user.credentials) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No security keys registered"})
+			return
+		}
+		assertion, session, err = h.webauthn.BeginLogin(user)
+		if err != nil {
+			log.Printf("Error beginning WebAuthn login: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting login"})
+			return
+		}
+	} else {
+		// Passwordless login must prove user verification (PIN or biometrics)
+		assertion, session, err = h.webauthn.BeginDiscoverableLogin(
+			webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			log.Printf("Error beginning WebAuthn login: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting login"})
+			return
+		}
+	}
+
+	sessionID, err := h.saveWebAuthnSession("login", userID, challengeJTI, session)
+	if err != nil {
+		log.Printf("Error saving WebAuthn session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_id": sessionID,
+		"options":    assertion,
+	})
+}
+
+// FinishWebAuthnLogin verifies the assertion returned by
+// navigator.credentials.get() for the ceremony in ?session_id= and issues
+// access and refresh tokens
+func (h *AuthHandler) FinishWebAuthnLogin(c *gin.Context) {
+	if !h.requireWebAuthn(c) {
+		return
+	}
+
+	session, sessionUserID, challengeJTI, err := h.takeWebAuthnSession(c.Query("session_id"), "login")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired WebAuthn session"})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid assertion"})
+		return
+	}
+
+	var user *webAuthnUser
+	var credential *webauthn.Credential
+	var attempt *loginAttempt
+	if sessionUserID != 0 {
+		// Second factor after a password login
+		user, err = h.loadWebAuthnUser(sessionUserID, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		var wait time.Duration
+		attempt, wait, err = h.beginAttempt(user.username, c.ClientIP(), "webauthn")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if wait > 0 {
+			rejectLockedOut(c, wait)
+			return
+		}
+		credential, err = h.webauthn.ValidateLogin(user, *session, parsed)
+		if err != nil {
+			log.Printf("WebAuthn login failed: %v", err)
+			h.LogUserActivity(user.id, "login_failed", "Failed login attempt: invalid security key assertion", c)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Security key verification failed"})
+			return
+		}
+	} else {
+		// Passwordless login: the credential identifies the user. The lockout
+		// is applied once the user is known, before the signature is checked.
+		var wait time.Duration
+		credential, err = h.webauthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			var userID int
+			err := h.db.QueryRow("SELECT id FROM users WHERE webauthn_user_handle = $1", userHandle).Scan(&userID)
+			if err == sql.ErrNoRows {
+				recordSecurityEvent(h.db, c, securityEventUnknownUser, "")
+			}
+			if err != nil {
+				return nil, err
+			}
+			user, err = h.loadWebAuthnUser(userID, false)
+			if err != nil {
+				return nil, err
+			}
+			attempt, wait, err = h.beginAttempt(user.username, c.ClientIP(), "webauthn")
+			if err != nil {
+				return nil, err
+			}
+			if wait > 0 {
+				return nil, errLockedOut
+			}
+			return user, nil
+		}, *session, parsed)
+		if wait > 0 {
+			rejectLockedOut(c, wait)
+			return
+		}
+		if err != nil || user == nil {
+			log.Printf("WebAuthn passwordless login failed: %v", err)
+			if attempt != nil {
+				h.LogUserActivity(user.id, "login_failed", "Failed passwordless login: invalid security key assertion", c)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Security key verification failed"})
+			return
+		}
+	}
+
+	if !h.updateWebAuthnCredential(c, user, credential, "login_failed") {
+		return
+	}
+	if attempt != nil {
+		attempt.succeeded()
+	}
+
+	// The 2FA challenge token can only be exchanged once
+	if challengeJTI != "" {
+		result, err := h.db.Exec(`
+			UPDATE login_challenges
+			SET used_at = CURRENT_TIMESTAMP
+			WHERE jti = $1 AND user_id = $2 AND used_at IS NULL AND expires_at > NOW()`,
+			challengeJTI, user.id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+			return
+		}
+	}
+
+	h.completeLogin(c, user.id, user.username)
+}
+
+// updateWebAuthnCredential rejects an assertion from a cloned authenticator,
+// logging failedActivity, and otherwise stores the credential's new sign
+// count. It responds and returns false if the assertion cannot be used.
+func (h *AuthHandler) updateWebAuthnCredential(c *gin.Context, user *webAuthnUser, credential *webauthn.Credential, failedActivity string) bool {
+	if credential.Authenticator.CloneWarning {
+		log.Printf("WebAuthn clone warning for user %d", user.id)
+		h.LogUserActivity(user.id, failedActivity, "Security key rejected: signature counter did not increase", c)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Security key verification failed"})
+		return false
+	}
+
+	_, err := h.db.Exec(`
+		UPDATE webauthn_credentials
+		SET sign_count = $1, backup_state = $2, last_used_at = CURRENT_TIMESTAMP
+		WHERE credential_id = $3 AND user_id = $4`,
+		int64(credential.Authenticator.SignCount), credential.Flags.BackupState, credential.ID, user.id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	return true
+}
+
+// hasWebAuthnCredentials reports whether the user registered any security key
+func (h *AuthHandler) hasWebAuthnCredentials(userID int) (bool, error) {
+	var exists bool
+	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM webauthn_credentials WHERE user_id = $1)", userID).Scan(&exists)
+	return exists, err
+}
+
+// loadWebAuthnUser loads a user with their credentials. If createHandle is
+// set, a random user handle is assigned to users that do not have one yet.
+func (h *AuthHandler) loadWebAuthnUser(userID int, createHandle bool) (*webAuthnUser, error) {
+	user := &webAuthnUser{id: userID}
+	err := h.db.QueryRow("SELECT username, webauthn_user_handle FROM users WHERE id = $1", userID).Scan(&user.username, &user.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(user.handle) == 0 && createHandle {
+		handle := make([]byte, 32)
+		if _, err := rand.Read(handle); err != nil {
+			return nil, err
+		}
+		_, err := h.db.Exec(`
+			UPDATE users SET webauthn_user_handle = $1
+			WHERE id = $2 AND webauthn_user_handle IS NULL`, handle, userID)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.db.QueryRow("SELECT webauthn_user_handle FROM users WHERE id = $1", userID).Scan(&user.handle); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := h.db.Query(`
+		SELECT credential_id, public_key, attestation_type, transports, aaguid,
+			sign_count, backup_eligible, backup_state
+		FROM webauthn_credentials
+		WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var credential webauthn.Credential
+		var transports string
+		var signCount int64
+		if err := rows.Scan(&credential.ID, &credential.PublicKey, &credential.AttestationType,
+			&transports, &credential.Authenticator.AAGUID, &signCount,
+			&credential.Flags.BackupEligible, &credential.Flags.BackupState); err != nil {
+			return nil, err
+		}
+		credential.Authenticator.SignCount = uint32(signCount)
+		for _, transport := range strings.Split(transports, ",") {
+			if transport != "" {
+				credential.Transport = append(credential.Transport, protocol.AuthenticatorTransport(transport))
+			}
+		}
+		user.credentials = append(user.credentials, credential)
+	}
+	return user, rows.Err()
+}
+
+// saveWebAuthnSession stores the ceremony state and returns its ID
+func (h *AuthHandler) saveWebAuthnSession(purpose string, userID int, challengeJTI string, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	sessionID, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO webauthn_sessions (id, purpose, user_id, challenge_jti, data, expires_at)
+		VALUES ($1, $2, NULLIF($3, 0), NULLIF($4, ''), $5, $6)`,
+		sessionID, purpose, userID, challengeJTI, string(data), time.Now().Add(webAuthnSessionExpiry))
+	if err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+// takeWebAuthnSession loads and deletes a ceremony, so each one can only be
+// finished once
+func (h *AuthHandler) takeWebAuthnSession(sessionID, purpose string) (*webauthn.SessionData, int, string, error) {
+	var data string
+	var userID sql.NullInt64
+	var challengeJTI sql.NullString
+	err := h.db.QueryRow(`
+		DELETE FROM webauthn_sessions
+		WHERE id = $1 AND purpose = $2 AND expires_at > NOW()
+		RETURNING user_id, challenge_jti, data`,
+		sessionID, purpose).Scan(&userID, &challengeJTI, &data)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, 0, "", err
+	}
+	return &session, int(userID.Int64), challengeJTI.String, nil
+}
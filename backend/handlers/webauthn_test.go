@@ -0,0 +1,628 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"wira-dashboard/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.ReleaseMode)
+	os.Setenv("APP_ENV", "development")
+	os.Setenv("JWT_SECRET", "test-secret-that-is-at-least-32-bytes-long")
+	if err := utils.LoadJWTSecret(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// testOrigin is one of the relying party origins NewWebAuthn allows by default
+const testOrigin = "http://localhost:5173"
+
+// softAuthenticator is a software security key: it creates an ES256
+// credential and signs assertions the way a browser and authenticator would
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// cborHeader encodes a CBOR major type with its length or value
+func cborHeader(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+}
+
+func cborText(s string) []byte  { return append(cborHeader(3, len(s)), s...) }
+func cborBytes(b []byte) []byte { return append(cborHeader(2, len(b)), b...) }
+
+// coseKey encodes the public key as a COSE EC2 key for ES256
+func (a *softAuthenticator) coseKey() []byte {
+	x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	key := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21}
+	key = append(key, cborBytes(x)...)
+	key = append(key, 0x22)
+	return append(key, cborBytes(y)...)
+}
+
+// authData builds authenticator data for the relying party. Flags: user
+// present and verified, plus attested credential data when attested is set.
+func (a *softAuthenticator) authData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := byte(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	if attested {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": b64url(challenge),
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// create answers navigator.credentials.create() with a "none" attestation
+func (a *softAuthenticator) create(t *testing.T, options protocol.CredentialCreation) []byte {
+	t.Helper()
+	handle, err := base64.RawURLEncoding.DecodeString(options.Response.User.ID.(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = handle
+
+	attestation := []byte{0xa3}
+	attestation = append(attestation, cborText("fmt")...)
+	attestation = append(attestation, cborText("none")...)
+	attestation = append(attestation, cborText("attStmt")...)
+	attestation = append(attestation, 0xa0)
+	attestation = append(attestation, cborText("authData")...)
+	attestation = append(attestation, cborBytes(a.authData(options.Response.RelyingParty.ID, true))...)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    b64url(a.credentialID),
+		"rawId": b64url(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64url(clientData(t, "webauthn.create", options.Response.Challenge)),
+			"attestationObject": b64url(attestation),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// get answers navigator.credentials.get(), bumping the signature counter
+func (a *softAuthenticator) get(t *testing.T, options protocol.CredentialAssertion) []byte {
+	t.Helper()
+	a.signCount++
+
+	authData := a.authData(options.Response.RelyingPartyID, false)
+	clientDataJSON := clientData(t, "webauthn.get", options.Response.Challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    b64url(a.credentialID),
+		"rawId": b64url(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"authenticatorData": b64url(authData),
+			"clientDataJSON":    b64url(clientDataJSON),
+			"signature":         b64url(signature),
+			"userHandle":        b64url(a.userHandle),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// webAuthnTest wires the WebAuthn handlers to a fake database
+type webAuthnTest struct {
+	t       *testing.T
+	db      *fakeDB
+	handler *AuthHandler
+	router  *gin.Engine
+}
+
+const (
+	testUserID   = 7
+	testUsername = "hangtuah"
+	testJTI      = "access-jti"
+	testPassword = "correct horse battery"
+)
+
+func newWebAuthnTest(t *testing.T) *webAuthnTest {
+	t.Helper()
+	fake, database := newFakeDB(t)
+	passwordHash, err := utils.HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.users[testUserID] = &fakeUser{username: testUsername, passwordHash: passwordHash}
+
+	webAuthn, err := NewWebAuthn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &AuthHandler{db: database, lockout: loadLockoutConfig(), webauthn: webAuthn}
+
+	// Stands in for AuthMiddleware
+	signedIn := func(c *gin.Context) {
+		c.Set("user_id", testUserID)
+		c.Set("username", testUsername)
+		c.Set("jti", testJTI)
+		c.Next()
+	}
+
+	r := gin.New()
+	r.POST("/register/begin", signedIn, h.BeginWebAuthnRegistration)
+	r.POST("/register/finish", signedIn, h.FinishWebAuthnRegistration)
+	r.POST("/login/begin", h.BeginWebAuthnLogin)
+	r.POST("/login/finish", h.FinishWebAuthnLogin)
+	r.POST("/reauthenticate/webauthn/begin", signedIn, h.BeginWebAuthnReauth)
+	r.POST("/reauthenticate/webauthn/finish", signedIn, h.FinishWebAuthnReauth)
+
+	return &webAuthnTest{t: t, db: fake, handler: h, router: r}
+}
+
+// post sends a JSON body and decodes the JSON response into out, if given
+func (wt *webAuthnTest) post(path string, body []byte, out interface{}) int {
+	wt.t.Helper()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	wt.router.ServeHTTP(w, req)
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			wt.t.Fatalf("POST %s: decoding %s: %v", path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func (wt *webAuthnTest) postJSON(path string, body interface{}, out interface{}) int {
+	wt.t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		wt.t.Fatal(err)
+	}
+	return wt.post(path, data, out)
+}
+
+// register runs a full registration ceremony for the authenticator
+func (wt *webAuthnTest) register(a *softAuthenticator) {
+	wt.t.Helper()
+	var begin struct {
+		SessionID string                      `json:"session_id"`
+		Options   protocol.CredentialCreation `json:"options"`
+	}
+	if code := wt.post("/register/begin", nil, &begin); code != http.StatusOK {
+		wt.t.Fatalf("register begin: status %d", code)
+	}
+	finish := "/register/finish?session_id=" + url.QueryEscape(begin.SessionID) + "&name=Test+key"
+	if code := wt.post(finish, a.create(wt.t, begin.Options), nil); code != http.StatusCreated {
+		wt.t.Fatalf("register finish: status %d", code)
+	}
+}
+
+type assertionBegin struct {
+	SessionID string                       `json:"session_id"`
+	Options   protocol.CredentialAssertion `json:"options"`
+}
+
+// beginLogin starts a login ceremony, as a second factor when challengeToken
+// is set and passwordless otherwise
+func (wt *webAuthnTest) beginLogin(challengeToken string) assertionBegin {
+	wt.t.Helper()
+	var begin assertionBegin
+	code := wt.postJSON("/login/begin", map[string]string{"challenge_token": challengeToken}, &begin)
+	if code != http.StatusOK {
+		wt.t.Fatalf("login begin: status %d", code)
+	}
+	return begin
+}
+
+func (wt *webAuthnTest) finishLogin(begin assertionBegin, assertion []byte) int {
+	wt.t.Helper()
+	return wt.post("/login/finish?session_id="+url.QueryEscape(begin.SessionID), assertion, nil)
+}
+
+// challengeToken issues a 2FA challenge token as Login does after a correct
+// password
+func (wt *webAuthnTest) challengeToken() string {
+	wt.t.Helper()
+	token, jti, err := utils.GenerateChallengeToken(testUserID, testUsername)
+	if err != nil {
+		wt.t.Fatal(err)
+	}
+	wt.db.challenges[jti] = &fakeChallenge{userID: testUserID}
+	return token
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+
+	wt.register(a)
+
+	cred := wt.db.credentialFor(a.credentialID)
+	if cred == nil {
+		t.Fatal("credential was not stored")
+	}
+	if cred.userID != testUserID || cred.attestationType != "none" || cred.signCount != 0 {
+		t.Errorf("stored credential = %+v", cred)
+	}
+	if handle := wt.db.users[testUserID].handle; len(handle) != 32 || !bytes.Equal(handle, a.userHandle) {
+		t.Errorf("user handle = %x, authenticator got %x", handle, a.userHandle)
+	}
+	if !wt.db.hasActivity("webauthn_registered") {
+		t.Error("registration was not logged")
+	}
+
+	// Registering again excludes the key that is already registered
+	var begin struct {
+		Options protocol.CredentialCreation `json:"options"`
+	}
+	if code := wt.post("/register/begin", nil, &begin); code != http.StatusOK {
+		t.Fatalf("second register begin: status %d", code)
+	}
+	if excluded := begin.Options.Response.CredentialExcludeList; len(excluded) != 1 ||
+		!bytes.Equal(excluded[0].CredentialID, a.credentialID) {
+		t.Errorf("exclude list = %+v, want the registered key", excluded)
+	}
+}
+
+func TestWebAuthnRegistrationRejectsBadAttestation(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+
+	var begin struct {
+		SessionID string                      `json:"session_id"`
+		Options   protocol.CredentialCreation `json:"options"`
+	}
+	wt.post("/register/begin", nil, &begin)
+
+	// Answer a different challenge than the one issued
+	begin.Options.Response.Challenge = protocol.URLEncodedBase64("not the challenge")
+	code := wt.post("/register/finish?session_id="+url.QueryEscape(begin.SessionID), a.create(t, begin.Options), nil)
+	if code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", code)
+	}
+	if len(wt.db.credentials) != 0 {
+		t.Error("credential stored for a bad attestation")
+	}
+}
+
+func TestWebAuthnSecondFactorLogin(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	begin := wt.beginLogin(wt.challengeToken())
+	if allowed := begin.Options.Response.AllowedCredentials; len(allowed) != 1 ||
+		!bytes.Equal(allowed[0].CredentialID, a.credentialID) {
+		t.Errorf("allowed credentials = %+v, want the registered key", allowed)
+	}
+
+	var tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	code := wt.post("/login/finish?session_id="+url.QueryEscape(begin.SessionID), a.get(t, begin.Options), &tokens)
+	if code != http.StatusOK {
+		t.Fatalf("status %d, want 200", code)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Error("no tokens issued")
+	}
+	if cred := wt.db.credentialFor(a.credentialID); cred.signCount != 1 {
+		t.Errorf("stored sign count = %d, want 1", cred.signCount)
+	}
+	if !wt.db.hasActivity("login") {
+		t.Error("login was not logged")
+	}
+}
+
+func TestWebAuthnSecondFactorLoginRejectsBadSignature(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	begin := wt.beginLogin(wt.challengeToken())
+	// Sign with a different key than the registered one
+	imposter := newSoftAuthenticator(t)
+	imposter.credentialID = a.credentialID
+	imposter.userHandle = a.userHandle
+
+	if code := wt.finishLogin(begin, imposter.get(t, begin.Options)); code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", code)
+	}
+	if types := wt.db.failureTypes(); len(types) != 1 || types[0] != "webauthn" {
+		t.Errorf("failed attempts = %v, want one webauthn failure", types)
+	}
+}
+
+func TestWebAuthnSecondFactorLoginLockout(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	wt.handler.lockout.DelayThreshold = 10
+	wt.handler.lockout.UsernameThreshold = 2
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	imposter := newSoftAuthenticator(t)
+	imposter.credentialID = a.credentialID
+	imposter.userHandle = a.userHandle
+	for i := 0; i < 2; i++ {
+		begin := wt.beginLogin(wt.challengeToken())
+		if code := wt.finishLogin(begin, imposter.get(t, begin.Options)); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d, want 401", i+1, code)
+		}
+	}
+
+	// Locked out, even with the right key
+	begin := wt.beginLogin(wt.challengeToken())
+	if code := wt.finishLogin(begin, a.get(t, begin.Options)); code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want 429", code)
+	}
+	if n := len(wt.db.failureTypes()); n != 2 {
+		t.Errorf("%d failed attempts stored, want 2", n)
+	}
+}
+
+func TestWebAuthnSecondFactorLoginClearsAttempt(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	begin := wt.beginLogin(wt.challengeToken())
+	if code := wt.finishLogin(begin, a.get(t, begin.Options)); code != http.StatusOK {
+		t.Fatalf("status %d, want 200", code)
+	}
+	if types := wt.db.failureTypes(); len(types) != 0 {
+		t.Errorf("failed attempts = %v after a successful login, want none", types)
+	}
+}
+
+func TestWebAuthnPasswordlessLogin(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	begin := wt.beginLogin("")
+	if len(begin.Options.Response.AllowedCredentials) != 0 {
+		t.Error("passwordless login should not name credentials")
+	}
+	if begin.Options.Response.UserVerification != protocol.VerificationRequired {
+		t.Errorf("user verification = %q, want required", begin.Options.Response.UserVerification)
+	}
+
+	if code := wt.finishLogin(begin, a.get(t, begin.Options)); code != http.StatusOK {
+		t.Fatalf("status %d, want 200", code)
+	}
+	if cred := wt.db.credentialFor(a.credentialID); cred.signCount != 1 {
+		t.Errorf("stored sign count = %d, want 1", cred.signCount)
+	}
+}
+
+func TestWebAuthnPasswordlessLoginUnknownUser(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	begin := wt.beginLogin("")
+	a.userHandle = []byte("someone else")
+	if code := wt.finishLogin(begin, a.get(t, begin.Options)); code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", code)
+	}
+	if len(wt.db.events) != 1 || wt.db.events[0] != securityEventUnknownUser {
+		t.Errorf("security events = %v, want one unknown user event", wt.db.events)
+	}
+}
+
+func TestWebAuthnPasswordlessLoginLockout(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	wt.handler.lockout.DelayThreshold = 10
+	wt.handler.lockout.UsernameThreshold = 2
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	imposter := newSoftAuthenticator(t)
+	imposter.credentialID = a.credentialID
+	imposter.userHandle = a.userHandle
+	for i := 0; i < 2; i++ {
+		begin := wt.beginLogin("")
+		if code := wt.finishLogin(begin, imposter.get(t, begin.Options)); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d, want 401", i+1, code)
+		}
+	}
+	if types := wt.db.failureTypes(); len(types) != 2 {
+		t.Fatalf("failed attempts = %v, want two", types)
+	}
+
+	// Locked out, even with the right key
+	begin := wt.beginLogin("")
+	if code := wt.finishLogin(begin, a.get(t, begin.Options)); code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want 429", code)
+	}
+}
+
+func TestWebAuthnSessionIsSingleUse(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	begin := wt.beginLogin("")
+	if code := wt.finishLogin(begin, a.get(t, begin.Options)); code != http.StatusOK {
+		t.Fatalf("first finish: status %d, want 200", code)
+	}
+	if code := wt.finishLogin(begin, a.get(t, begin.Options)); code != http.StatusBadRequest {
+		t.Errorf("replayed finish: status %d, want 400", code)
+	}
+
+	// A ceremony cannot be finished as another kind
+	var reg struct {
+		SessionID string `json:"session_id"`
+	}
+	wt.post("/register/begin", nil, &reg)
+	if code := wt.finishLogin(assertionBegin{SessionID: reg.SessionID, Options: begin.Options}, a.get(t, begin.Options)); code != http.StatusBadRequest {
+		t.Errorf("registration session used for login: status %d, want 400", code)
+	}
+}
+
+func TestWebAuthnChallengeTokenIsSingleUse(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	// Two ceremonies started from the same challenge token can only complete
+	// the login once
+	token := wt.challengeToken()
+	first := wt.beginLogin(token)
+	second := wt.beginLogin(token)
+
+	if code := wt.finishLogin(first, a.get(t, first.Options)); code != http.StatusOK {
+		t.Fatalf("first finish: status %d, want 200", code)
+	}
+	if code := wt.finishLogin(second, a.get(t, second.Options)); code != http.StatusUnauthorized {
+		t.Errorf("second finish: status %d, want 401", code)
+	}
+}
+
+func TestWebAuthnLoginRejectsClonedAuthenticator(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	begin := wt.beginLogin(wt.challengeToken())
+	if code := wt.finishLogin(begin, a.get(t, begin.Options)); code != http.StatusOK {
+		t.Fatalf("first login: status %d, want 200", code)
+	}
+
+	// A copy of the key still at the old counter signs the same count again
+	a.signCount = 0
+	token := wt.challengeToken()
+	begin = wt.beginLogin(token)
+	if code := wt.finishLogin(begin, a.get(t, begin.Options)); code != http.StatusUnauthorized {
+		t.Errorf("cloned key: status %d, want 401", code)
+	}
+	if cred := wt.db.credentialFor(a.credentialID); cred.signCount != 1 {
+		t.Errorf("stored sign count = %d, want it left at 1", cred.signCount)
+	}
+	if !wt.db.hasActivity("login_failed") {
+		t.Error("cloned key was not logged")
+	}
+	// The rejected assertion did not use up the challenge token, and the
+	// genuine key, ahead of the clone, still works
+	a.signCount = 5
+	begin = wt.beginLogin(token)
+	if code := wt.finishLogin(begin, a.get(t, begin.Options)); code != http.StatusOK {
+		t.Errorf("genuine key after clone warning: status %d, want 200", code)
+	}
+	if cred := wt.db.credentialFor(a.credentialID); cred.signCount != 6 {
+		t.Errorf("stored sign count = %d, want 6", cred.signCount)
+	}
+}
+
+func TestWebAuthnReauthentication(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+	wt.register(a)
+
+	if code := wt.postJSON("/reauthenticate/webauthn/begin", map[string]string{"password": "wrong"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("wrong password: status %d, want 401", code)
+	}
+
+	var begin assertionBegin
+	if code := wt.postJSON("/reauthenticate/webauthn/begin", map[string]string{"password": testPassword}, &begin); code != http.StatusOK {
+		t.Fatalf("begin: status %d, want 200", code)
+	}
+	finish := "/reauthenticate/webauthn/finish?session_id=" + url.QueryEscape(begin.SessionID)
+	if code := wt.post(finish, a.get(t, begin.Options), nil); code != http.StatusOK {
+		t.Fatalf("finish: status %d, want 200", code)
+	}
+	if !wt.db.reauthed[testJTI] {
+		t.Error("access token was not marked re-authenticated")
+	}
+	if code := wt.post(finish, a.get(t, begin.Options), nil); code != http.StatusBadRequest {
+		t.Errorf("replayed finish: status %d, want 400", code)
+	}
+}
+
+func TestNewWebAuthnRequiresRelyingPartyOutsideDevelopment(t *testing.T) {
+	t.Setenv("APP_ENV", "production")
+	t.Setenv("WEBAUTHN_RP_ID", "")
+	t.Setenv("WEBAUTHN_RP_ORIGINS", "")
+	if _, err := NewWebAuthn(); err == nil {
+		t.Error("NewWebAuthn succeeded without WEBAUTHN_RP_ID")
+	}
+
+	t.Setenv("WEBAUTHN_RP_ID", "dashboard.example.com")
+	t.Setenv("WEBAUTHN_RP_ORIGINS", "https://dashboard.example.com")
+	if _, err := NewWebAuthn(); err != nil {
+		t.Errorf("NewWebAuthn: %v", err)
+	}
+}
@@ -1,28 +1,53 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-contrib/cors"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"wira-dashboard/db"
+	"wira-dashboard/handlers"
+	"wira-dashboard/middleware"
 	"wira-dashboard/routes"
+	"wira-dashboard/utils"
 )
 
 func main() {
 	// Load .env file
+	// Local secrets first: godotenv never overrides a variable already set
+	_ = godotenv.Load(".env.local")
 	if err := godotenv.Load(); err != nil {
 		log.Println("Warning: .env file not found")
 	}
 
+	// "main verify-audit" checks the audit log hash chain and exits
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(verifyAudit())
+	}
+
 	// Set Gin to Release mode
 	gin.SetMode(gin.ReleaseMode)
 
 	// Create a new router with default middleware
 	r := gin.Default()
 
+	// Only the reverse proxies in TRUSTED_PROXIES (IPs or CIDRs) may set
+	// X-Forwarded-For. Without it the client IP is the connection's address,
+	// so clients cannot pick the IP used for rate limits, lockouts and the
+	// audit log.
+	if err := r.SetTrustedProxies(utils.GetEnvList("TRUSTED_PROXIES")); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+
 	// CORS configuration
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{
@@ -34,8 +59,8 @@ func main() {
 		"https://ricrym.aqash.xyz",
 	}
 	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization"}
-	config.ExposeHeaders = []string{"Content-Length"}
+	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", "X-API-Key"}
+	config.ExposeHeaders = []string{"Content-Length", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"}
 	config.AllowCredentials = true
 
 	r.Use(cors.New(config))
@@ -45,6 +70,41 @@ func main() {
 		SkipPaths: []string{"/favicon.ico"},
 	}))
 
+	// Load the key used to sign access tokens
+	if err := utils.LoadJWTSecret(); err != nil {
+		log.Fatal("Failed to load JWT secret:", err)
+	}
+
+	// Load the key used to encrypt TOTP secrets
+	secrets, err := utils.LoadSecretBox()
+	if err != nil {
+		log.Fatal("Failed to load TOTP encryption keys:", err)
+	}
+
+	// TOTP period and drift window
+	totpConfig, err := utils.LoadTOTPConfig()
+	if err != nil {
+		log.Fatal("Invalid TOTP configuration:", err)
+	}
+
+	// WebAuthn relying party for security keys and passkeys
+	webAuthn, err := handlers.NewWebAuthn()
+	if err != nil {
+		log.Fatal("Failed to configure WebAuthn:", err)
+	}
+
+	// Mailer for password reset links
+	mailer, err := utils.LoadMailer()
+	if err != nil {
+		log.Fatal("Failed to configure mailer:", err)
+	}
+
+	// Blob store for uploaded avatars
+	blobs, err := utils.LoadBlobStore()
+	if err != nil {
+		log.Fatal("Failed to configure blob store:", err)
+	}
+
 	// Initialize database
 	database, err := db.InitDB()
 	if err != nil {
@@ -52,16 +112,101 @@ func main() {
 	}
 	defer database.Close()
 
+	// Encrypt TOTP secrets stored in plaintext or with a retired key
+	if err := db.EncryptTOTPSecrets(database, secrets); err != nil {
+		log.Fatal("Failed to encrypt TOTP secrets:", err)
+	}
+
+	// Give the admin role to the bootstrap administrators
+	if err := db.PromoteAdmins(database, os.Getenv("ADMIN_USERNAMES")); err != nil {
+		log.Fatal("Failed to promote admins:", err)
+	}
+
+	// Purge expired tokens in the background
+	cleanupInterval := utils.GetEnvDuration("TOKEN_CLEANUP_INTERVAL", time.Hour)
+	stopCleanup := db.StartTokenCleanup(database, cleanupInterval, blobs)
+
+	// Rate limiting, in memory by default or shared between replicas
+	var rateLimitStore middleware.RateLimitStore
+	switch store := os.Getenv("RATE_LIMIT_STORE"); store {
+	case "", "memory":
+		rateLimitStore = middleware.NewMemoryRateLimitStore()
+	case "postgres":
+		rateLimitStore = middleware.NewPostgresRateLimitStore(database)
+	default:
+		log.Fatalf("Unknown RATE_LIMIT_STORE %q", store)
+	}
+	limiter := middleware.NewRateLimiter(middleware.DefaultRateLimitPolicies(), rateLimitStore, time.Minute, 3*time.Minute)
+
 	// Setup routes
-	routes.SetupRoutes(r, database)
+	routes.SetupRoutes(r, database, limiter, secrets, totpConfig, webAuthn, mailer, blobs)
 
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8081"
 	}
-	log.Println("Server starting on :", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: r,
+	}
+
+	// Stop on SIGINT or SIGTERM: finish in-flight requests, then stop the
+	// background jobs before the database is closed
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Println("Server starting on :", port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+
+	var startErr error
+	select {
+	case startErr = <-serverErr:
+	case <-ctx.Done():
+		log.Println("Shutting down server")
+	}
+
+	shutdownTimeout := utils.GetEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error shutting down server:", err)
+	}
+
+	limiter.Stop()
+	stopCleanup()
+
+	if startErr != nil {
+		database.Close()
+		log.Fatal("Failed to start server:", startErr)
+	}
+}
+
+// verifyAudit checks the audit log hash chain, printing the result, and
+// returns the exit code: 0 if the chain is intact, 1 if it is broken and 2 on
+// errors
+func verifyAudit() int {
+	database, err := db.InitDB()
+	if err != nil {
+		log.Println("Failed to connect to database:", err)
+		return 2
+	}
+	defer database.Close()
+
+	result, err := db.VerifyAuditLog(database)
+	if err != nil {
+		log.Println("Failed to verify audit log:", err)
+		return 2
+	}
+	if !result.Valid {
+		fmt.Printf("Audit log BROKEN at entry %d: %s (%d entries checked)\n", result.BrokenAt, result.Reason, result.Entries)
+		return 1
 	}
+	fmt.Printf("Audit log intact: %d entries, last hash %s\n", result.Entries, result.LastHash)
+	return 0
 }
@@ -1,14 +1,22 @@
 package middleware
 
 import (
+	"crypto/subtle"
+	"database/sql"
+	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"wira-dashboard/utils"
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 )
 
-// AuthMiddleware verifies the JWT token in the Authorization header
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware verifies the JWT token in the Authorization header, rejects
+// tokens that were not issued by the server, have been revoked or belong to a
+// disabled user, and loads the user's current role and permissions
+func AuthMiddleware(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -26,24 +34,195 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		claims, err := utils.ValidateJWT(parts[1])
+		claims, err := utils.ValidateTokenType(parts[1], utils.TokenTypeAccess)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
+		// Only tokens the server issued and has not revoked are accepted. The
+		// role and permissions come from the database, not the token, so a
+		// role change takes effect immediately.
+		jti, _ := (*claims)["jti"].(string)
+		userID, _ := (*claims)["user_id"].(float64)
+		if jti == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
+		var username, role string
+		var permissions []string
+		var revoked bool
+		err = db.QueryRow(`
+			SELECT u.username, u.role,
+				ARRAY(SELECT rp.permission FROM role_permissions rp WHERE rp.role = u.role ORDER BY rp.permission),
+				EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = t.jti)
+			FROM access_tokens t
+			JOIN users u ON u.id = t.user_id
+			WHERE t.jti = $1 AND t.user_id = $2 AND t.expires_at > NOW() AND u.disabled_at IS NULL`,
+			jti, int(userID)).Scan(&username, &role, pq.Array(&permissions), &revoked)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking access token: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+		if revoked {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+			c.Abort()
+			return
+		}
+
 		// Store user information in the context
-		c.Set("user_id", int((*claims)["user_id"].(float64)))
-		c.Set("username", (*claims)["username"].(string))
+		c.Set("user_id", int(userID))
+		c.Set("username", username)
+		c.Set("jti", jti)
+		c.Set("role", role)
+		c.Set("permissions", permissions)
 		c.Next()
 	}
 }
 
-// Optional2FA middleware checks if 2FA is required for the user
-func Optional2FA() gin.HandlerFunc {
+// Optional2FA requires a recent step-up verification for sensitive account
+// changes: the current access token must have been re-authenticated through
+// /api/auth/reauthenticate (password, plus a TOTP code when the user has 2FA
+// enabled) within REAUTH_WINDOW. It must run after AuthMiddleware.
+func Optional2FA(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// TODO: Implement 2FA check when needed
+		window := utils.ReauthWindow()
+
+		var recent bool
+		err := db.QueryRow(`
+			SELECT EXISTS(
+				SELECT 1 FROM access_tokens
+				WHERE jti = $1 AND user_id = $2
+					AND reauthenticated_at > NOW() - $3 * INTERVAL '1 second'
+			)`, c.GetString("jti"), c.GetInt("user_id"), int64(window.Seconds())).Scan(&recent)
+		if err != nil {
+			log.Printf("Error checking re-authentication: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+		if !recent {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":           "Re-authentication required",
+				"reauth_required": true,
+			})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
+
+// defaultVerifiedEmailActions are the actions that need a verified email
+// unless EMAIL_VERIFICATION_REQUIRED_FOR says otherwise: linking a game
+// account and exporting personal data or activity history
+const defaultVerifiedEmailActions = "link_game_account,export_data,export_activities"
+
+// RequireVerifiedEmail blocks users who have not verified their email from
+// the named action when it is listed in the comma-separated
+// EMAIL_VERIFICATION_REQUIRED_FOR environment variable (default
+// defaultVerifiedEmailActions). It must run after AuthMiddleware.
+func RequireVerifiedEmail(db *sql.DB, action string) gin.HandlerFunc {
+	actions := os.Getenv("EMAIL_VERIFICATION_REQUIRED_FOR")
+	if actions == "" {
+		actions = defaultVerifiedEmailActions
+	}
+	required := false
+	for _, name := range strings.Split(actions, ",") {
+		if strings.TrimSpace(name) == action {
+			required = true
+		}
+	}
+
+	return func(c *gin.Context) {
+		if !required {
+			c.Next()
+			return
+		}
+
+		var verified bool
+		err := db.QueryRow("SELECT email_verified FROM users WHERE id = $1", c.GetInt("user_id")).Scan(&verified)
+		if err != nil {
+			log.Printf("Error checking email verification: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+		if !verified {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":                 "Email verification required",
+				"verification_required": true,
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireRole only allows users whose role, as carried in the access token,
+// is one of roles. It must run after AuthMiddleware.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient role"})
+		c.Abort()
+	}
+}
+
+// RequirePermission only allows users whose role grants the permission, as
+// loaded by AuthMiddleware. It must run after AuthMiddleware.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, granted := range c.GetStringSlice("permissions") {
+			if granted == permission {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		c.Abort()
+	}
+}
+
+// RequireGameAPIKey only allows requests from game servers that send one of
+// the keys in the comma-separated GAME_API_KEYS environment variable in the
+// X-API-Key header. The position of the matching key is stored as api_key_id
+// for KeyByAPIKey.
+func RequireGameAPIKey() gin.HandlerFunc {
+	var keys [][]byte
+	for _, key := range strings.Split(os.Getenv("GAME_API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+
+	return func(c *gin.Context) {
+		provided := []byte(c.GetHeader("X-API-Key"))
+		for i, key := range keys {
+			if subtle.ConstantTimeCompare(provided, key) == 1 {
+				c.Set("api_key_id", strconv.Itoa(i+1))
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+	}
+}
@@ -1,72 +1,275 @@
 package middleware
 
 import (
-	"github.com/gin-gonic/gin"
-	"golang.org/x/time/rate"
+	"context"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
 )
 
+// KeyFunc extracts the key a request is rate limited by
+type KeyFunc func(c *gin.Context) string
+
+// KeyByIP limits requests per client IP
+func KeyByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// KeyByUserID limits requests per authenticated user, falling back to the
+// client IP for anonymous requests. It must run after AuthMiddleware.
+func KeyByUserID(c *gin.Context) string {
+	if userID, exists := c.Get("user_id"); exists {
+		return fmt.Sprintf("user:%v", userID)
+	}
+	return KeyByIP(c)
+}
+
+// KeyByAPIKey limits requests per game API key, falling back to the client IP
+// when no verified key was sent. It must run after RequireGameAPIKey; the raw
+// X-API-Key header is never used, so made-up keys share the IP's bucket.
+func KeyByAPIKey(c *gin.Context) string {
+	if keyID := c.GetString("api_key_id"); keyID != "" {
+		return "api_key:" + keyID
+	}
+	return KeyByIP(c)
+}
+
+// RateLimitPolicy describes a named token bucket limit
+type RateLimitPolicy struct {
+	Name  string
+	Rate  rate.Limit // tokens added per second
+	Burst int        // maximum bucket size
+	Key   KeyFunc
+}
+
+// DefaultRateLimitPolicies returns the built-in policies, with overrides read
+// from RATE_LIMIT_<NAME>_RPS, RATE_LIMIT_<NAME>_BURST and RATE_LIMIT_<NAME>_KEY
+// (ip, user or api_key)
+func DefaultRateLimitPolicies() []RateLimitPolicy {
+	policies := []RateLimitPolicy{
+		// Strict limit for login and registration
+		{Name: "auth", Rate: rate.Every(12 * time.Second), Burst: 5, Key: KeyByIP},
+		// Looser limit for public leaderboard reads
+		{Name: "rankings", Rate: 10, Burst: 30, Key: KeyByIP},
+		// Sensitive actions of a signed-in user, mounted after AuthMiddleware
+		{Name: "account", Rate: rate.Every(12 * time.Second), Burst: 5, Key: KeyByUserID},
+	}
+	for i := range policies {
+		policies[i] = policyFromEnv(policies[i])
+	}
+	return policies
+}
+
+// policyFromEnv applies environment overrides to a policy
+func policyFromEnv(p RateLimitPolicy) RateLimitPolicy {
+	prefix := "RATE_LIMIT_" + strings.ToUpper(p.Name) + "_"
+
+	if v := os.Getenv(prefix + "RPS"); v != "" {
+		if rps, err := strconv.ParseFloat(v, 64); err == nil && rps > 0 {
+			p.Rate = rate.Limit(rps)
+		} else {
+			log.Printf("Warning: invalid %sRPS %q", prefix, v)
+		}
+	}
+	if v := os.Getenv(prefix + "BURST"); v != "" {
+		if burst, err := strconv.Atoi(v); err == nil && burst > 0 {
+			p.Burst = burst
+		} else {
+			log.Printf("Warning: invalid %sBURST %q", prefix, v)
+		}
+	}
+	switch v := os.Getenv(prefix + "KEY"); v {
+	case "":
+	case "ip":
+		p.Key = KeyByIP
+	case "user":
+		p.Key = KeyByUserID
+	case "api_key":
+		p.Key = KeyByAPIKey
+	default:
+		log.Printf("Warning: invalid %sKEY %q", prefix, v)
+	}
+	return p
+}
+
+// RateLimitResult is the outcome of taking a token from a bucket
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAfter time.Duration // time until the bucket is full again
+	RetryAfter time.Duration // time until the next request is allowed
+}
+
+// RateLimitStore keeps the bucket state for rate limit keys. Implementations
+// must be safe for concurrent use.
+type RateLimitStore interface {
+	// Take consumes one request for key under the policy
+	Take(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error)
+	// Cleanup removes state for keys that have been idle for longer than idleTTL
+	Cleanup(ctx context.Context, idleTTL time.Duration) error
+}
+
+// RateLimiter applies named rate limit policies on top of a RateLimitStore
+// and owns the goroutine that evicts idle keys
+type RateLimiter struct {
+	policies map[string]RateLimitPolicy
+	store    RateLimitStore
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewRateLimiter creates a rate limiter for the given policies and starts
+// evicting keys that have been idle for longer than idleTTL. A nil store
+// selects the in-memory store. Call Stop to release the cleanup goroutine.
+func NewRateLimiter(policies []RateLimitPolicy, store RateLimitStore, cleanupInterval, idleTTL time.Duration) *RateLimiter {
+	if store == nil {
+		store = NewMemoryRateLimitStore()
+	}
+
+	rl := &RateLimiter{
+		policies: make(map[string]RateLimitPolicy),
+		store:    store,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, p := range policies {
+		if p.Key == nil {
+			p.Key = KeyByIP
+		}
+		rl.policies[p.Name] = p
+	}
+
+	go rl.cleanup(cleanupInterval, idleTTL)
+	return rl
+}
+
+// Stop stops the cleanup goroutine and waits for it to exit
+func (rl *RateLimiter) Stop() {
+	rl.once.Do(func() {
+		close(rl.stop)
+	})
+	<-rl.done
+}
+
+// cleanup removes idle keys every interval until Stop is called
+func (rl *RateLimiter) cleanup(interval, idleTTL time.Duration) {
+	defer close(rl.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := rl.store.Cleanup(context.Background(), idleTTL); err != nil {
+				log.Printf("Error cleaning up rate limit state: %v", err)
+			}
+		case <-rl.stop:
+			return
+		}
+	}
+}
+
 // Define a visitor struct to hold the rate limiter and last seen time
 type visitor struct {
 	limiter  *rate.Limiter
 	lastSeen time.Time
 }
 
-// Define a struct to hold visitors
-type rateLimiter struct {
+// memoryRateLimitStore keeps token buckets in process memory. Limits are not
+// shared between replicas.
+type memoryRateLimitStore struct {
 	visitors map[string]*visitor
-	mu       sync.RWMutex
-	r        rate.Limit
-	b        int
-}
-
-// Create a new rate limiter
-var limiter = &rateLimiter{
-	visitors: make(map[string]*visitor),
-	r:        1,    // 1 request per second
-	b:        5,    // burst of 5 requests
-}
-
-// Clean up old entries every minute
-func init() {
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			limiter.mu.Lock()
-			for ip, v := range limiter.visitors {
-				if time.Since(v.lastSeen) > 3*time.Minute {
-					delete(limiter.visitors, ip)
-				}
-			}
-			limiter.mu.Unlock()
-		}
-	}()
+	mu       sync.Mutex
+	now      func() time.Time
+}
+
+// NewMemoryRateLimitStore creates the default per-process store
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{visitors: make(map[string]*visitor), now: time.Now}
 }
 
-// getVisitor creates a new rate limiter for a visitor if it doesn't exist
-func (rl *rateLimiter) getVisitor(ip string) *rate.Limiter {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+// Take consumes a token from the visitor's bucket for the policy
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	v, exists := rl.visitors[ip]
+	now := s.now()
+	bucketKey := p.Name + "|" + key
+	v, exists := s.visitors[bucketKey]
 	if !exists {
-		limiter := rate.NewLimiter(rl.r, rl.b)
-		rl.visitors[ip] = &visitor{limiter: limiter, lastSeen: time.Now()}
-		return limiter
+		v = &visitor{limiter: rate.NewLimiter(p.Rate, p.Burst)}
+		s.visitors[bucketKey] = v
+	}
+	v.lastSeen = now
+
+	result := RateLimitResult{Limit: p.Burst}
+	reservation := v.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		result.RetryAfter = delay
+	} else {
+		result.Allowed = true
 	}
 
-	v.lastSeen = time.Now()
-	return v.limiter
+	tokens := v.limiter.TokensAt(now)
+	if tokens > 0 {
+		result.Remaining = int(tokens)
+	}
+	if missing := float64(p.Burst) - tokens; missing > 0 && p.Rate > 0 {
+		result.ResetAfter = time.Duration(missing / float64(p.Rate) * float64(time.Second))
+	}
+	return result, nil
+}
+
+// Cleanup removes visitors that have not been seen for longer than idleTTL
+func (s *memoryRateLimitStore) Cleanup(ctx context.Context, idleTTL time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, v := range s.visitors {
+		if s.now().Sub(v.lastSeen) > idleTTL {
+			delete(s.visitors, key)
+		}
+	}
+	return nil
 }
 
-// RateLimit middleware function
-func RateLimit() gin.HandlerFunc {
+// Limit returns a middleware enforcing the named policy. It sets the
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers on every
+// response and Retry-After when the request is rejected.
+func (rl *RateLimiter) Limit(policyName string) gin.HandlerFunc {
+	p, ok := rl.policies[policyName]
+	if !ok {
+		panic("middleware: unknown rate limit policy " + policyName)
+	}
+
 	return func(c *gin.Context) {
-		ip := c.ClientIP()
-		limiter := limiter.getVisitor(ip)
-		if !limiter.Allow() {
+		result, err := rl.store.Take(c.Request.Context(), p.Key(c), p)
+		if err != nil {
+			// Fail open so an unavailable store does not take the API down
+			log.Printf("Error applying rate limit policy %s: %v", p.Name, err)
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+
+		if !result.Allowed {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
 			c.JSON(http.StatusTooManyRequests, gin.H{
 				"error": "Rate limit exceeded. Please try again later.",
 			})
@@ -76,3 +279,8 @@ func RateLimit() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
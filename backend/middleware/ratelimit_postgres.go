@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+)
+
+// postgresRateLimitStore shares rate limit state between backend replicas
+// through the rate_limits table. It implements GCRA (generic cell rate
+// algorithm): each key stores a theoretical arrival time (TAT) and a request
+// is allowed while the TAT is no further ahead of now than the burst
+// tolerance. Time is taken from the database clock so replicas agree.
+type postgresRateLimitStore struct {
+	db *sql.DB
+}
+
+// NewPostgresRateLimitStore creates a store backed by the rate_limits table
+func NewPostgresRateLimitStore(db *sql.DB) RateLimitStore {
+	return &postgresRateLimitStore{db: db}
+}
+
+// Take consumes one request for key under the policy
+func (s *postgresRateLimitStore) Take(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error) {
+	result := RateLimitResult{Limit: p.Burst}
+	if p.Rate <= 0 {
+		return result, nil
+	}
+
+	bucketKey := p.Name + "|" + key
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rate_limits (key, tat, updated_at)
+		VALUES ($1, 0, CURRENT_TIMESTAMP)
+		ON CONFLICT (key) DO NOTHING`, bucketKey)
+	if err != nil {
+		return result, err
+	}
+
+	var tat, now int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT tat, (EXTRACT(EPOCH FROM clock_timestamp()) * 1000000)::BIGINT
+		FROM rate_limits
+		WHERE key = $1
+		FOR UPDATE`, bucketKey).Scan(&tat, &now)
+	if err != nil {
+		return result, err
+	}
+
+	newTAT, result := gcra(tat, now, p)
+	if !result.Allowed {
+		return result, tx.Commit()
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE rate_limits
+		SET tat = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE key = $2`, newTAT, bucketKey)
+	if err != nil {
+		return RateLimitResult{Limit: p.Burst}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return RateLimitResult{Limit: p.Burst}, err
+	}
+	return result, nil
+}
+
+// gcra applies one request at now to a key whose theoretical arrival time is
+// tat, both in microseconds. It returns the TAT to store, unchanged when the
+// request is rejected. p.Rate must be positive.
+func gcra(tat, now int64, p RateLimitPolicy) (int64, RateLimitResult) {
+	result := RateLimitResult{Limit: p.Burst}
+
+	// Emission interval and burst tolerance in microseconds
+	interval := int64(math.Ceil(1e6 / float64(p.Rate)))
+	tolerance := interval * int64(p.Burst)
+
+	if tat < now {
+		tat = now
+	}
+	newTAT := tat + interval
+	allowAt := newTAT - tolerance
+
+	if now < allowAt {
+		result.RetryAfter = time.Duration(allowAt-now) * time.Microsecond
+		result.ResetAfter = time.Duration(tat-now) * time.Microsecond
+		return tat, result
+	}
+
+	result.Allowed = true
+	result.Remaining = int((now - allowAt) / interval)
+	result.ResetAfter = time.Duration(newTAT-now) * time.Microsecond
+	return newTAT, result
+}
+
+// Cleanup removes keys whose state has not changed for longer than idleTTL
+func (s *postgresRateLimitStore) Cleanup(ctx context.Context, idleTTL time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM rate_limits
+		WHERE updated_at < NOW() - $1 * INTERVAL '1 second'`, int64(idleTTL.Seconds()))
+	return err
+}
@@ -0,0 +1,299 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// fakeClock is a manually advanced clock shared by a store and its test
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// gcraStore stands in for postgresRateLimitStore: it keeps each key's TAT in
+// a map instead of the rate_limits table and runs the same gcra step
+type gcraStore struct {
+	mu    sync.Mutex
+	tats  map[string]int64
+	clock *fakeClock
+}
+
+func (s *gcraStore) Take(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucketKey := p.Name + "|" + key
+	tat, result := gcra(s.tats[bucketKey], s.clock.Now().UnixMicro(), p)
+	s.tats[bucketKey] = tat
+	return result, nil
+}
+
+func (s *gcraStore) Cleanup(ctx context.Context, idleTTL time.Duration) error {
+	return nil
+}
+
+// rateLimitStores returns a fresh instance of every store under test, each
+// driven by clock
+var rateLimitStores = map[string]func(clock *fakeClock) RateLimitStore{
+	"memory": func(clock *fakeClock) RateLimitStore {
+		s := NewMemoryRateLimitStore().(*memoryRateLimitStore)
+		s.now = clock.Now
+		return s
+	},
+	"gcra": func(clock *fakeClock) RateLimitStore {
+		return &gcraStore{tats: make(map[string]int64), clock: clock}
+	},
+}
+
+// testPolicy allows one request per second with a burst of three
+var testPolicy = RateLimitPolicy{Name: "test", Rate: rate.Limit(1), Burst: 3, Key: KeyByIP}
+
+func TestRateLimitStoreBurst(t *testing.T) {
+	for name, newStore := range rateLimitStores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(newFakeClock())
+
+			for i := 0; i < testPolicy.Burst; i++ {
+				result, err := store.Take(context.Background(), "ip:1.2.3.4", testPolicy)
+				if err != nil {
+					t.Fatalf("request %d: %v", i+1, err)
+				}
+				want := RateLimitResult{
+					Allowed:    true,
+					Limit:      3,
+					Remaining:  testPolicy.Burst - i - 1,
+					ResetAfter: time.Duration(i+1) * time.Second,
+				}
+				if result != want {
+					t.Errorf("request %d = %+v, want %+v", i+1, result, want)
+				}
+			}
+
+			result, err := store.Take(context.Background(), "ip:1.2.3.4", testPolicy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := RateLimitResult{Limit: 3, ResetAfter: 3 * time.Second, RetryAfter: time.Second}
+			if result != want {
+				t.Errorf("request over burst = %+v, want %+v", result, want)
+			}
+
+			// Other keys have their own bucket
+			result, err = store.Take(context.Background(), "ip:5.6.7.8", testPolicy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Allowed || result.Remaining != 2 {
+				t.Errorf("other key = %+v, want allowed with 2 remaining", result)
+			}
+		})
+	}
+}
+
+func TestRateLimitStoreRefill(t *testing.T) {
+	for name, newStore := range rateLimitStores {
+		t.Run(name, func(t *testing.T) {
+			clock := newFakeClock()
+			store := newStore(clock)
+			take := func() RateLimitResult {
+				t.Helper()
+				result, err := store.Take(context.Background(), "ip:1.2.3.4", testPolicy)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return result
+			}
+
+			for i := 0; i < testPolicy.Burst; i++ {
+				take()
+			}
+			if result := take(); result.Allowed {
+				t.Fatalf("request over burst allowed: %+v", result)
+			}
+
+			// A rejected request does not use up the next token
+			clock.Advance(time.Second)
+			result := take()
+			want := RateLimitResult{Allowed: true, Limit: 3, ResetAfter: 3 * time.Second}
+			if result != want {
+				t.Errorf("after one interval = %+v, want %+v", result, want)
+			}
+			if result := take(); result.Allowed || result.RetryAfter != time.Second {
+				t.Errorf("second request after one interval = %+v, want rejected for 1s", result)
+			}
+
+			// The bucket refills completely, but no further than the burst
+			clock.Advance(time.Minute)
+			for i := 0; i < testPolicy.Burst; i++ {
+				if result := take(); !result.Allowed || result.Remaining != testPolicy.Burst-i-1 {
+					t.Errorf("request %d after refill = %+v", i+1, result)
+				}
+			}
+			if result := take(); result.Allowed {
+				t.Errorf("request over burst after refill allowed: %+v", result)
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimitStoreCleanup(t *testing.T) {
+	clock := newFakeClock()
+	store := rateLimitStores["memory"](clock).(*memoryRateLimitStore)
+
+	store.Take(context.Background(), "ip:1.2.3.4", testPolicy)
+	clock.Advance(time.Minute)
+	store.Take(context.Background(), "ip:5.6.7.8", testPolicy)
+	clock.Advance(time.Minute)
+
+	if err := store.Cleanup(context.Background(), 90*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.visitors["test|ip:1.2.3.4"]; ok {
+		t.Error("idle key was not removed")
+	}
+	if _, ok := store.visitors["test|ip:5.6.7.8"]; !ok {
+		t.Error("recent key was removed")
+	}
+}
+
+func TestRateLimiterLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for name, newStore := range rateLimitStores {
+		t.Run(name, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter := NewRateLimiter([]RateLimitPolicy{testPolicy}, newStore(clock), time.Hour, time.Hour)
+			defer limiter.Stop()
+
+			r := gin.New()
+			r.GET("/", limiter.Limit("test"), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+			get := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "1.2.3.4:1234"
+				r.ServeHTTP(w, req)
+				return w
+			}
+
+			for i := 0; i < testPolicy.Burst; i++ {
+				w := get()
+				if w.Code != http.StatusOK {
+					t.Fatalf("request %d: status %d, want 200", i+1, w.Code)
+				}
+				wantHeaders := map[string]string{
+					"RateLimit-Limit":     "3",
+					"RateLimit-Remaining": strconv.Itoa(testPolicy.Burst - i - 1),
+					"RateLimit-Reset":     strconv.Itoa(i + 1),
+					"Retry-After":         "",
+				}
+				for header, want := range wantHeaders {
+					if got := w.Header().Get(header); got != want {
+						t.Errorf("request %d: %s = %q, want %q", i+1, header, got, want)
+					}
+				}
+			}
+
+			clock.Advance(500 * time.Millisecond)
+			w := get()
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("request over burst: status %d, want 429", w.Code)
+			}
+			wantHeaders := map[string]string{
+				"RateLimit-Limit":     "3",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "3", // 2.5s rounded up
+				"Retry-After":         "1", // 0.5s rounded up
+			}
+			for header, want := range wantHeaders {
+				if got := w.Header().Get(header); got != want {
+					t.Errorf("rejected request: %s = %q, want %q", header, got, want)
+				}
+			}
+			if body := w.Body.String(); body != `{"error":"Rate limit exceeded. Please try again later."}` {
+				t.Errorf("rejected request body = %s", body)
+			}
+
+			clock.Advance(500 * time.Millisecond)
+			if w := get(); w.Code != http.StatusOK {
+				t.Errorf("request after Retry-After: status %d, want 200", w.Code)
+			}
+		})
+	}
+}
+
+func TestRateLimiterUnknownPolicy(t *testing.T) {
+	limiter := NewRateLimiter(nil, nil, time.Hour, time.Hour)
+	defer limiter.Stop()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Limit did not panic for an unknown policy")
+		}
+	}()
+	limiter.Limit("missing")
+}
+
+func TestKeyByAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GAME_API_KEYS", "first, second")
+
+	tests := []struct {
+		name    string
+		header  string
+		wantKey string
+	}{
+		{"verified key", "second", "api_key:2"},
+		{"unknown key", "made-up", "ip:1.2.3.4"},
+		{"no key", "", "ip:1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var key string
+			r := gin.New()
+			r.GET("/", func(c *gin.Context) {
+				// The limiter runs after RequireGameAPIKey, but unknown keys
+				// are rejected there; key them here to check the fallback
+				RequireGameAPIKey()(c)
+				key = KeyByAPIKey(c)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "1.2.3.4:1234"
+			if tt.header != "" {
+				req.Header.Set("X-API-Key", tt.header)
+			}
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			if key != tt.wantKey {
+				t.Errorf("KeyByAPIKey = %q, want %q", key, tt.wantKey)
+			}
+		})
+	}
+}
@@ -1,11 +1,60 @@
+-- Create roles table
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(20) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    rank INTEGER NOT NULL
+);
+
+INSERT INTO roles (name, description, rank) VALUES
+    ('player', 'Regular dashboard user', 0),
+    ('moderator', 'Can moderate players and scores', 1),
+    ('admin', 'Full administrative access', 2)
+ON CONFLICT (name) DO NOTHING;
+
+-- Create role_permissions table
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role VARCHAR(20) REFERENCES roles(name) ON DELETE CASCADE,
+    permission VARCHAR(50) NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('moderator', 'lockouts:manage'),
+    ('admin', 'lockouts:manage'),
+    ('admin', 'roles:manage'),
+    ('moderator', 'scores:void'),
+    ('admin', 'scores:void'),
+    ('moderator', 'accounts:ban'),
+    ('admin', 'accounts:ban'),
+    ('moderator', 'users:read'),
+    ('admin', 'users:read'),
+    ('admin', 'users:manage'),
+    ('admin', 'audit:read'),
+    ('moderator', 'security:read'),
+    ('admin', 'security:read')
+ON CONFLICT DO NOTHING;
+
 -- Create users table
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
     username VARCHAR(255) UNIQUE NOT NULL,
     email VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
-    two_factor_secret VARCHAR(32),
+    two_factor_secret TEXT, -- AES-GCM encrypted, see utils.SecretBox
     two_factor_enabled BOOLEAN DEFAULT false,
+    two_factor_last_used BIGINT, -- start (Unix seconds) of the last accepted TOTP time-step
+    two_factor_pending_secret TEXT,
+    two_factor_pending_expires_at TIMESTAMP WITH TIME ZONE,
+    webauthn_user_handle BYTEA UNIQUE,
+    email_verified BOOLEAN NOT NULL DEFAULT true, -- Register inserts new users as unverified
+    role VARCHAR(20) NOT NULL DEFAULT 'player' REFERENCES roles(name),
+    disabled_at TIMESTAMP WITH TIME ZONE,
+    disabled_reason TEXT,
+    deletion_requested_at TIMESTAMP WITH TIME ZONE, -- see db.PurgeDeletedUsers
+    deletion_scheduled_for TIMESTAMP WITH TIME ZONE,
+    display_name VARCHAR(50),
+    bio TEXT,
+    avatar_key VARCHAR(255), -- key in the blob store, see utils.BlobStore
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
@@ -16,13 +65,205 @@ CREATE TABLE IF NOT EXISTS refresh_tokens (
     user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
     token VARCHAR(255) UNIQUE NOT NULL,
     expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    user_agent TEXT,
+    ip_address VARCHAR(45),
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create access_tokens table to track issued JWTs by their jti
+CREATE TABLE IF NOT EXISTS access_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    session_id INTEGER REFERENCES refresh_tokens(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    reauthenticated_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_access_tokens_user_id ON access_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_access_tokens_session_id ON access_tokens(session_id);
+
+-- Create revoked_tokens table (denylist of access tokens keyed by jti)
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create login_challenges table for single-use 2FA challenge tokens
+CREATE TABLE IF NOT EXISTS login_challenges (
+    jti VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create two_factor_recovery_codes table (SHA-256 hashes of one-time codes)
+CREATE TABLE IF NOT EXISTS two_factor_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_two_factor_recovery_codes_user_id ON two_factor_recovery_codes(user_id);
+
+-- Create webauthn_credentials table (passkeys and security keys)
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    credential_id BYTEA UNIQUE NOT NULL,
+    public_key BYTEA NOT NULL,
+    attestation_type VARCHAR(32) NOT NULL DEFAULT '',
+    transports VARCHAR(255) NOT NULL DEFAULT '',
+    aaguid BYTEA,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    backup_eligible BOOLEAN NOT NULL DEFAULT false,
+    backup_state BOOLEAN NOT NULL DEFAULT false,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+
+-- Create webauthn_sessions table for in-flight registration and login ceremonies
+CREATE TABLE IF NOT EXISTS webauthn_sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    purpose VARCHAR(20) NOT NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    challenge_jti VARCHAR(64),
+    data TEXT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Create password_reset_tokens table (only SHA-256 hashes of the tokens are stored)
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    ip_address VARCHAR(45),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens(user_id);
+
+-- Create email_verification_tokens table (only SHA-256 hashes of the tokens are stored)
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    purpose VARCHAR(20) NOT NULL DEFAULT 'verify', -- 'verify' the current address or 'change' to a new one
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE INDEX IF NOT EXISTS idx_email_verification_tokens_user_id ON email_verification_tokens(user_id);
+
+-- Create rate_limits table for the shared (multi-replica) rate limiter
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key VARCHAR(255) PRIMARY KEY,
+    tat BIGINT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Create failed_attempts table for rate limiting login attempts
 CREATE TABLE IF NOT EXISTS failed_attempts (
     id SERIAL PRIMARY KEY,
     username VARCHAR(255) NOT NULL,
     ip_address VARCHAR(45) NOT NULL,
+    attempt_type VARCHAR(20) NOT NULL DEFAULT 'password',
     attempt_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
+
+CREATE INDEX IF NOT EXISTS idx_failed_attempts_username ON failed_attempts(username, attempt_time);
+CREATE INDEX IF NOT EXISTS idx_failed_attempts_ip_address ON failed_attempts(ip_address, attempt_time);
+
+-- Create security_events table for events that belong to no user, such as
+-- logins with an unknown username; per-user events go to user_activities
+CREATE TABLE IF NOT EXISTS security_events (
+    id BIGSERIAL PRIMARY KEY,
+    event_type VARCHAR(50) NOT NULL,
+    username VARCHAR(255) NOT NULL DEFAULT '',
+    ip_address VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_security_events_ip_address ON security_events(ip_address, event_type, created_at);
+CREATE INDEX IF NOT EXISTS idx_security_events_username ON security_events(username, created_at);
+CREATE INDEX IF NOT EXISTS idx_security_events_created_at ON security_events(created_at);
+
+-- Create audit_log table: append-only, each row's hash covers its contents and
+-- the previous row's hash (see db.VerifyAuditLog). actor_id has no foreign key
+-- so entries outlive deleted users.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    actor_id INTEGER,
+    action VARCHAR(50) NOT NULL,
+    target_type VARCHAR(30) NOT NULL DEFAULT '',
+    target_id VARCHAR(64) NOT NULL DEFAULT '',
+    metadata JSONB NOT NULL DEFAULT '{}',
+    prev_hash CHAR(64) NOT NULL,
+    hash CHAR(64) UNIQUE NOT NULL,
+    actor_hash CHAR(64)
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_log_actor_id ON audit_log(actor_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target_type, target_id);
+
+-- Create audit_log_actors table: the username, IP address and user agent behind
+-- an audit entry. Kept outside the hash chain so they can be deleted when the
+-- user's account is purged; audit_log.actor_hash covers them with the row's
+-- salt. Rows can be deleted but not changed.
+CREATE TABLE IF NOT EXISTS audit_log_actors (
+    audit_id BIGINT PRIMARY KEY REFERENCES audit_log(id),
+    actor_id INTEGER,
+    actor_username VARCHAR(255) NOT NULL DEFAULT '',
+    ip_address VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    salt CHAR(32) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_actors_actor_id ON audit_log_actors(actor_id);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+CREATE TRIGGER audit_log_no_truncate
+    BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
+
+CREATE OR REPLACE FUNCTION audit_log_actors_delete_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log_actors rows can only be deleted';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_actors_delete_only ON audit_log_actors;
+CREATE TRIGGER audit_log_actors_delete_only
+    BEFORE UPDATE ON audit_log_actors
+    FOR EACH ROW EXECUTE FUNCTION audit_log_actors_delete_only();
+
+DROP TRIGGER IF EXISTS audit_log_actors_no_truncate ON audit_log_actors;
+CREATE TRIGGER audit_log_actors_no_truncate
+    BEFORE TRUNCATE ON audit_log_actors
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_actors_delete_only();
@@ -0,0 +1,41 @@
+-- Links between dashboard users and game accounts, and moderation of game
+-- data. Requires the users table from auth.sql and the accounts table from
+-- database/init.sql.
+CREATE TABLE IF NOT EXISTS user_game_accounts (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    acc_id INTEGER NOT NULL UNIQUE REFERENCES accounts(acc_id) ON DELETE CASCADE, -- a game account belongs to one user
+    linked_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, acc_id)
+);
+
+-- One-time codes shown in-game to link an account (only SHA-256 hashes are stored)
+CREATE TABLE IF NOT EXISTS game_link_codes (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    acc_id INTEGER NOT NULL REFERENCES accounts(acc_id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_game_link_codes_acc_id ON game_link_codes(acc_id);
+
+-- Moderation: voided scores and banned or suspended accounts are left out of
+-- rankings and stats
+ALTER TABLE scores ADD COLUMN IF NOT EXISTS voided_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE scores ADD COLUMN IF NOT EXISTS void_reason TEXT;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS banned_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS banned_until TIMESTAMP WITH TIME ZONE; -- NULL with banned_at set is a permanent ban
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS ban_reason TEXT;
+
+-- Trail of moderation actions taken by staff
+CREATE TABLE IF NOT EXISTS moderation_actions (
+    id SERIAL PRIMARY KEY,
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    action VARCHAR(30) NOT NULL, -- score_void, score_restore, account_ban, account_suspend, account_unban
+    acc_id INTEGER REFERENCES accounts(acc_id) ON DELETE SET NULL,
+    score_id INTEGER REFERENCES scores(score_id) ON DELETE SET NULL,
+    reason TEXT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_moderation_actions_acc_id ON moderation_actions(acc_id);
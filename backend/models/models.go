@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type Account struct {
 	AccID    int    `json:"acc_id"`
 	Username string `json:"username"`
@@ -31,3 +33,51 @@ type PaginatedResponse struct {
 	PerPage int         `json:"per_page"`
 	Data    interface{} `json:"data"`
 }
+
+// CharacterSummary is a character with its score statistics and the rank of
+// its account in the character's class. Score fields are null when the
+// character has no scores.
+type CharacterSummary struct {
+	CharID       int        `json:"char_id"`
+	AccID        int        `json:"acc_id"`
+	Username     string     `json:"username"`
+	ClassID      int        `json:"class_id"`
+	BestScore    *int       `json:"best_score"`
+	AverageScore *float64   `json:"average_score"`
+	LastScore    *int       `json:"last_score"`
+	LastPlayedAt *time.Time `json:"last_played_at"`
+	RunCount     int        `json:"run_count"`
+	ClassRank    *int       `json:"class_rank"`
+}
+
+type GameAccountLink struct {
+	AccID    int       `json:"acc_id"`
+	Username string    `json:"username"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+type ScoreEntry struct {
+	ScoreID     int       `json:"score_id"`
+	CharID      int       `json:"char_id"`
+	ClassID     int       `json:"class_id"`
+	RewardScore int       `json:"reward_score"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type PlayerProfile struct {
+	Username   string             `json:"username"`
+	CreatedAt  time.Time          `json:"created_at"`
+	Characters []CharacterSummary `json:"characters"`
+	History    PaginatedResponse  `json:"history"`
+}
+
+type ModerationAction struct {
+	ID        int        `json:"id"`
+	Actor     string     `json:"actor"`
+	Action    string     `json:"action"`
+	AccID     *int       `json:"acc_id"`
+	ScoreID   *int       `json:"score_id"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
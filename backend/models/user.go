@@ -19,13 +19,12 @@ type User struct {
 type LoginRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
-	TOTPCode string `json:"totp_code"`
 }
 
 type RegisterRequest struct {
 	Username string `json:"username" binding:"required,min=3,max=30"`
 	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=8"`
+	Password string `json:"password" binding:"required"`
 }
 
 type TokenResponse struct {
@@ -39,5 +38,86 @@ type Enable2FARequest struct {
 }
 
 type Verify2FARequest struct {
-	TOTPCode string `json:"totp_code" binding:"required"`
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	TOTPCode       string `json:"totp_code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+type Session struct {
+	ID         int       `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+type ReauthenticateRequest struct {
+	Password string `json:"password" binding:"required"`
+	TOTPCode string `json:"totp_code"`
+}
+
+type UserProfile struct {
+	ID               int       `json:"id"`
+	Username         string    `json:"username"`
+	Email            string    `json:"email"`
+	EmailVerified    bool      `json:"email_verified"`
+	PendingEmail     *string   `json:"pending_email"` // waiting for confirmation, see ChangeEmail
+	DisplayName      *string   `json:"display_name"`
+	Bio              *string   `json:"bio"`
+	AvatarURL        *string   `json:"avatar_url"`
+	Role             string    `json:"role"`
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+type AdminUser struct {
+	ID               int        `json:"id"`
+	Username         string     `json:"username"`
+	Email            string     `json:"email"`
+	Role             string     `json:"role"`
+	EmailVerified    bool       `json:"email_verified"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+	DisabledAt       *time.Time `json:"disabled_at"`
+	DisabledReason   *string    `json:"disabled_reason"`
+	// DeletionScheduledFor is set while the user's account deletion is pending
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for"`
+	ActiveSessions       int        `json:"active_sessions"`
+	LastLoginAt          *time.Time `json:"last_login_at"`
+	CreatedAt            time.Time  `json:"created_at"`
+}
+
+type Activity struct {
+	ID          int       `json:"id"`
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	IPAddress   string    `json:"ip_address"`
+	UserAgent   string    `json:"user_agent"`
+	CreatedAt   time.Time `json:"timestamp"`
+}
+
+type SecurityEvent struct {
+	ID        int64     `json:"id"`
+	EventType string    `json:"event_type"`
+	Username  string    `json:"username"`
+	IPAddress string    `json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AuditEntry struct {
+	ID            int64                  `json:"id"`
+	CreatedAt     time.Time              `json:"created_at"`
+	ActorID       *int                   `json:"actor_id"`
+	ActorUsername string                 `json:"actor_username"`
+	Action        string                 `json:"action"`
+	TargetType    string                 `json:"target_type"`
+	TargetID      string                 `json:"target_id"`
+	Metadata      map[string]interface{} `json:"metadata"`
+	IPAddress     string                 `json:"ip_address"`
+	UserAgent     string                 `json:"user_agent"`
+	PrevHash      string                 `json:"prev_hash"`
+	Hash          string                 `json:"hash"`
+	ActorHash     string                 `json:"actor_hash,omitempty"`
 }
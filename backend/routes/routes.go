@@ -3,14 +3,23 @@ package routes
 import (
 	"database/sql"
 	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"wira-dashboard/handlers"
 	"wira-dashboard/middleware"
+	"wira-dashboard/utils"
 )
 
-func SetupRoutes(r *gin.Engine, db *sql.DB) {
+func SetupRoutes(r *gin.Engine, db *sql.DB, limiter *middleware.RateLimiter, secrets *utils.SecretBox, totp *utils.TOTPConfig, webAuthn *webauthn.WebAuthn, mailer utils.Mailer, blobs utils.BlobStore) {
 	// Create handlers
 	rankingHandler := handlers.NewHandler(db)
-	authHandler := handlers.NewAuthHandler(db)
+	authHandler := handlers.NewAuthHandler(db, secrets, totp, webAuthn, mailer, blobs)
+	authMiddleware := middleware.AuthMiddleware(db)
+	stepUp := middleware.Optional2FA(db)
+
+	// Uploads kept on the local filesystem are served by the API
+	if local, ok := blobs.(*utils.LocalBlobStore); ok {
+		r.Static(local.URLPrefix, local.Dir)
+	}
 
 	// API routes group
 	api := r.Group("/api")
@@ -18,38 +27,125 @@ func SetupRoutes(r *gin.Engine, db *sql.DB) {
 		// Public auth routes
 		auth := api.Group("/auth")
 		{
-			auth.POST("/register", authHandler.Register)
-			auth.POST("/login", authHandler.Login)
+			auth.POST("/register", limiter.Limit("auth"), authHandler.Register)
+			auth.POST("/login", limiter.Limit("auth"), authHandler.Login)
+			auth.POST("/2fa/verify", limiter.Limit("auth"), authHandler.Verify2FA)
+			auth.POST("/forgot-password", limiter.Limit("auth"), authHandler.ForgotPassword)
+			auth.POST("/reset-password", limiter.Limit("auth"), authHandler.ResetPassword)
+			auth.POST("/verify-email", limiter.Limit("auth"), authHandler.VerifyEmail)
 			auth.POST("/refresh", authHandler.RefreshToken)
+			auth.POST("/logout", authHandler.Logout)
+			auth.POST("/logout-all", authMiddleware, authHandler.LogoutAll)
+			auth.POST("/reauthenticate", authMiddleware, limiter.Limit("account"), authHandler.Reauthenticate)
+			auth.POST("/reauthenticate/webauthn/begin", authMiddleware, limiter.Limit("account"), authHandler.BeginWebAuthnReauth)
+			auth.POST("/reauthenticate/webauthn/finish", authMiddleware, limiter.Limit("account"), authHandler.FinishWebAuthnReauth)
+		}
+
+		// Public WebAuthn login (second factor or passwordless)
+		webAuthnLogin := api.Group("/2fa/webauthn/login")
+		webAuthnLogin.Use(limiter.Limit("auth"))
+		{
+			webAuthnLogin.POST("/begin", authHandler.BeginWebAuthnLogin)
+			webAuthnLogin.POST("/finish", authHandler.FinishWebAuthnLogin)
+		}
+
+		// Game server endpoints
+		game := api.Group("/game")
+		game.Use(middleware.RequireGameAPIKey())
+		{
+			game.POST("/link-codes", authHandler.CreateGameLinkCode)
 		}
 
 		// Public rankings endpoints
 		rankings := api.Group("/rankings")
+		rankings.Use(limiter.Limit("rankings"))
 		{
 			rankings.GET("", rankingHandler.GetRankings)
 			rankings.GET("/search", rankingHandler.SearchRankings)
 			rankings.GET("/stats", rankingHandler.GetClassStats)
 		}
 
-		// Protected routes
+		// Public player profiles
+		players := api.Group("/players")
+		players.Use(limiter.Limit("rankings"))
+		{
+			players.GET("/:username", rankingHandler.GetPlayerProfile)
+		}
+
+		// Protected routes. Limits keyed by user ("account") must come after
+		// authMiddleware, which sets the user ID they are keyed by.
 		protected := api.Group("")
-		protected.Use(middleware.AuthMiddleware())
+		protected.Use(authMiddleware)
 		{
 			// User profile routes
 			user := protected.Group("/user")
 			{
 				user.GET("/profile", authHandler.GetProfile)
-				user.POST("/change-password", authHandler.ChangePassword)
+				user.PATCH("/profile", authHandler.UpdateProfile)
+				user.POST("/change-password", stepUp, authHandler.ChangePassword)
+				user.POST("/change-email", stepUp, authHandler.ChangeEmail)
+				user.POST("/verify-email/resend", limiter.Limit("account"), authHandler.ResendVerificationEmail)
 				user.GET("/activities", authHandler.GetUserActivities)
+				user.GET("/activities/export", middleware.RequireVerifiedEmail(db, "export_activities"), authHandler.ExportUserActivities)
+				user.GET("/sessions", authHandler.GetSessions)
+				user.DELETE("/sessions/:id", authHandler.RevokeSession)
+				user.GET("/game-accounts", authHandler.GetGameAccounts)
+				user.POST("/game-accounts/link", limiter.Limit("account"), middleware.RequireVerifiedEmail(db, "link_game_account"), authHandler.LinkGameAccount)
+				user.DELETE("/game-accounts/:acc_id", authHandler.UnlinkGameAccount)
+				user.GET("/characters", authHandler.GetUserCharacters)
+				user.GET("/export", limiter.Limit("account"), middleware.RequireVerifiedEmail(db, "export_data"), authHandler.ExportUserData)
+				user.DELETE("", stepUp, authHandler.DeleteAccount)
 			}
 
 			// 2FA routes
 			twoFA := protected.Group("/2fa")
 			{
 				twoFA.GET("/status", authHandler.Get2FAStatus)
-				twoFA.POST("/setup", authHandler.Setup2FA)
+				twoFA.POST("/setup", stepUp, authHandler.Setup2FA)
+				twoFA.GET("/setup/qr", authHandler.Get2FAQRCode)
 				twoFA.POST("/enable", authHandler.Enable2FA)
-				twoFA.POST("/disable", authHandler.Disable2FA)
+				twoFA.POST("/disable", stepUp, authHandler.Disable2FA)
+				twoFA.POST("/recovery-codes", authHandler.RegenerateRecoveryCodes)
+				twoFA.POST("/webauthn/register/begin", stepUp, authHandler.BeginWebAuthnRegistration)
+				twoFA.POST("/webauthn/register/finish", authHandler.FinishWebAuthnRegistration)
+				twoFA.GET("/webauthn/credentials", authHandler.GetWebAuthnCredentials)
+				twoFA.DELETE("/webauthn/credentials/:id", stepUp, authHandler.DeleteWebAuthnCredential)
+			}
+
+			// Admin routes
+			admin := protected.Group("/admin")
+			admin.Use(middleware.RequireRole(utils.RoleModerator, utils.RoleAdmin))
+			{
+				admin.POST("/lockouts/unlock", middleware.RequirePermission(utils.PermissionManageLockouts), authHandler.UnlockLogin)
+				admin.GET("/roles", middleware.RequirePermission(utils.PermissionManageRoles), authHandler.GetRoles)
+				admin.PUT("/users/:id/role", middleware.RequirePermission(utils.PermissionManageRoles), authHandler.SetUserRole)
+
+				// User management
+				readUsers := middleware.RequirePermission(utils.PermissionReadUsers)
+				manageUsers := middleware.RequirePermission(utils.PermissionManageUsers)
+				admin.GET("/users", readUsers, authHandler.ListUsers)
+				admin.GET("/users/:id", readUsers, authHandler.GetUser)
+				admin.GET("/users/:id/activities", readUsers, authHandler.GetUserActivitiesAdmin)
+				admin.POST("/users/:id/force-password-reset", manageUsers, authHandler.ForcePasswordReset)
+				admin.POST("/users/:id/reset-2fa", manageUsers, authHandler.ResetUser2FA)
+				admin.POST("/users/:id/revoke-sessions", manageUsers, authHandler.RevokeUserSessions)
+				admin.POST("/users/:id/disable", manageUsers, authHandler.DisableUser)
+				admin.POST("/users/:id/enable", manageUsers, authHandler.EnableUser)
+
+				// Audit log
+				admin.GET("/audit-log", middleware.RequirePermission(utils.PermissionReadAuditLog), authHandler.GetAuditLog)
+				admin.GET("/audit-log/verify", middleware.RequirePermission(utils.PermissionReadAuditLog), authHandler.VerifyAuditLog)
+
+				// Security events
+				admin.GET("/security-events", middleware.RequirePermission(utils.PermissionReadSecurity), authHandler.GetSecurityEvents)
+				admin.GET("/security-events/unknown-users", middleware.RequirePermission(utils.PermissionReadSecurity), authHandler.GetUnknownUserReport)
+
+				// Moderation
+				admin.POST("/scores/:id/void", middleware.RequirePermission(utils.PermissionVoidScores), rankingHandler.VoidScore)
+				admin.POST("/scores/:id/restore", middleware.RequirePermission(utils.PermissionVoidScores), rankingHandler.RestoreScore)
+				admin.POST("/accounts/:acc_id/ban", middleware.RequirePermission(utils.PermissionBanAccounts), rankingHandler.BanAccount)
+				admin.POST("/accounts/:acc_id/unban", middleware.RequirePermission(utils.PermissionBanAccounts), rankingHandler.UnbanAccount)
+				admin.GET("/moderation-actions", rankingHandler.GetModerationActions)
 			}
 		}
 
@@ -2,27 +2,103 @@ package utils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	jwtSecret    = []byte("your-secret-key") // TODO: Move to environment variable
-	tokenExpiry  = time.Hour * 24            // 24 hours
+	jwtSecret            []byte            // set by LoadJWTSecret
+	TokenExpiry          = time.Hour * 24  // 24 hours
+	ChallengeTokenExpiry = time.Minute * 5 // 5 minutes
 )
 
-// GenerateJWT creates a new JWT token for a user
-func GenerateJWT(userID int, username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// errJWTSecretNotLoaded is returned when tokens are used before LoadJWTSecret
+var errJWTSecretNotLoaded = fmt.Errorf("JWT secret not loaded")
+
+// minJWTSecretLength is the shortest JWT_SECRET accepted, in bytes
+const minJWTSecretLength = 32
+
+// LoadJWTSecret reads the key that signs access and challenge tokens from
+// JWT_SECRET. It must be set and at least 32 bytes long.
+func LoadJWTSecret() error {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return fmt.Errorf("JWT_SECRET is not set")
+	}
+	if len(secret) < minJWTSecretLength {
+		return fmt.Errorf("JWT_SECRET must be at least %d bytes", minJWTSecretLength)
+	}
+	jwtSecret = []byte(secret)
+	return nil
+}
+
+// Token types stored in the "typ" claim so a token issued for one purpose
+// cannot be used for another
+const (
+	TokenTypeAccess       = "access"
+	TokenType2FAChallenge = "2fa_challenge"
+)
+
+// GenerateJWT creates a new JWT token for a user carrying their role and
+// permissions, and returns it together with its unique token ID (jti), which
+// is used for revocation
+func GenerateJWT(userID int, username, role string, permissions []string) (string, string, error) {
+	return generateToken(userID, username, TokenTypeAccess, TokenExpiry, jwt.MapClaims{
+		"role":        role,
+		"permissions": permissions,
+	})
+}
+
+// GenerateChallengeToken creates a short-lived token proving that the user
+// passed the password step of a 2FA login, and returns it with its jti
+func GenerateChallengeToken(userID int, username string) (string, string, error) {
+	return generateToken(userID, username, TokenType2FAChallenge, ChallengeTokenExpiry, nil)
+}
+
+// generateToken signs a JWT of the given type with any extra claims
+func generateToken(userID int, username, tokenType string, expiry time.Duration, extra jwt.MapClaims) (string, string, error) {
+	jti, err := generateTokenID()
+	if err != nil {
+		return "", "", err
+	}
+
+	claims := jwt.MapClaims{
 		"user_id":  userID,
 		"username": username,
-		"exp":      time.Now().Add(tokenExpiry).Unix(),
-	})
-	return token.SignedString(jwtSecret)
+		"jti":      jti,
+		"typ":      tokenType,
+		"exp":      time.Now().Add(expiry).Unix(),
+	}
+	for key, value := range extra {
+		claims[key] = value
+	}
+	if len(jwtSecret) == 0 {
+		return "", "", errJWTSecretNotLoaded
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString(jwtSecret)
+	if err != nil {
+		return "", "", err
+	}
+	return signed, jti, nil
+}
+
+// generateTokenID generates a random identifier for a JWT
+func generateTokenID() (string, error) {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
 }
 
 // ValidateJWT validates a JWT token and returns the claims
@@ -31,6 +107,9 @@ func ValidateJWT(tokenString string) (*jwt.MapClaims, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
+		if len(jwtSecret) == 0 {
+			return nil, errJWTSecretNotLoaded
+		}
 		return jwtSecret, nil
 	})
 
@@ -45,6 +124,19 @@ func ValidateJWT(tokenString string) (*jwt.MapClaims, error) {
 	return nil, fmt.Errorf("invalid token")
 }
 
+// ValidateTokenType validates a JWT and checks that it was issued for the
+// given purpose
+func ValidateTokenType(tokenString, tokenType string) (*jwt.MapClaims, error) {
+	claims, err := ValidateJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if typ, _ := (*claims)["typ"].(string); typ != tokenType {
+		return nil, fmt.Errorf("unexpected token type")
+	}
+	return claims, nil
+}
+
 // HashPassword creates a bcrypt hash of a password
 func HashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -60,34 +152,49 @@ func CheckPassword(password, hash string) bool {
 	return err == nil
 }
 
-// Generate2FASecret generates a new TOTP secret
-func Generate2FASecret() (string, string, error) {
-    // Generate random bytes for the secret
-    bytes := make([]byte, 20)
-    _, err := rand.Read(bytes)
-    if err != nil {
-        return "", "", err
-    }
-
-    // Generate the QR code URL using the generated secret
-    key, err := totp.Generate(totp.GenerateOpts{
-        Issuer:      "WIRA Dashboard",
-        AccountName: "user",
-        Secret:      bytes,
-        SecretSize:  20,
-        Period:      30,
-        Digits:      6,
-    })
-    if err != nil {
-        return "", "", err
-    }
-
-    return key.Secret(), key.URL(), nil
+// GenerateEmailToken generates a URL-safe single-use token for links sent by
+// email, such as password resets
+func GenerateEmailToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// linkCodeAlphabet leaves out characters that are easily confused in game
+// fonts (0/O, 1/I)
+const linkCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// GenerateLinkCode generates a short one-time code formatted as "XXXX-XXXX"
+// for players to type from the game into the dashboard
+func GenerateLinkCode() (string, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	code := make([]byte, 0, 9)
+	for i, b := range bytes {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		code = append(code, linkCodeAlphabet[int(b)%len(linkCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// NormalizeLinkCode uppercases a link code and removes dashes and spaces
+func NormalizeLinkCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
 }
 
-// Validate2FACode validates a TOTP code
-func Validate2FACode(secret, code string) bool {
-    return totp.Validate(code, secret)
+// HashToken hashes a single-use token for storage. A fast hash is enough
+// because the tokens are long random strings.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 // GenerateRefreshToken generates a new refresh token
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore stores user uploads such as avatars under slash-separated keys
+type BlobStore interface {
+	Put(key, contentType string, data []byte) error
+	Delete(key string) error
+	// URL returns where clients can download the blob
+	URL(key string) string
+}
+
+// LoadBlobStore selects the blob store from BLOB_STORE. "local" (the default)
+// keeps blobs under BLOB_DIR (default "uploads"), served by the API at
+// BLOB_URL_PREFIX (default "/api/uploads").
+func LoadBlobStore() (BlobStore, error) {
+	switch store := os.Getenv("BLOB_STORE"); store {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		prefix := os.Getenv("BLOB_URL_PREFIX")
+		if prefix == "" {
+			prefix = "/api/uploads"
+		}
+		return &LocalBlobStore{Dir: dir, URLPrefix: strings.TrimSuffix(prefix, "/")}, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", store)
+	}
+}
+
+// LocalBlobStore keeps blobs as files on the local filesystem. The API serves
+// Dir at URLPrefix (see routes.SetupRoutes).
+type LocalBlobStore struct {
+	Dir       string
+	URLPrefix string
+}
+
+// path returns the file a key is stored in, rejecting keys that would
+// escape Dir
+func (s *LocalBlobStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)[1:]
+	if clean == "" || clean != key {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(clean)), nil
+}
+
+// Put writes the blob to its file, replacing any existing one
+func (s *LocalBlobStore) Put(key, contentType string, data []byte) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see a partial blob
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Delete removes the blob's file; deleting a missing blob is not an error
+func (s *LocalBlobStore) Delete(key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// URL returns the blob's path under URLPrefix
+func (s *LocalBlobStore) URL(key string) string {
+	return s.URLPrefix + "/" + key
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetEnvInt reads an integer environment variable, returning fallback if it
+// is unset or invalid
+func GetEnvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %d", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+// GetEnvDuration reads a duration environment variable (e.g. "15m"),
+// returning fallback if it is unset or invalid
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid %s %q, using %s", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+// IsDevelopment reports whether APP_ENV is "development". Insecure local
+// defaults, such as localhost WebAuthn origins, are only used then.
+func IsDevelopment() bool {
+	return os.Getenv("APP_ENV") == "development"
+}
+
+// GetEnvList reads a comma-separated environment variable, skipping empty
+// entries. It returns nil if the variable is unset.
+func GetEnvList(key string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ReauthWindow is how long a re-authentication allows sensitive account
+// changes, read from REAUTH_WINDOW
+func ReauthWindow() time.Duration {
+	return GetEnvDuration("REAUTH_WINDOW", 5*time.Minute)
+}
+
+// AppURL returns the absolute URL of a frontend path, using APP_BASE_URL for
+// links sent by email
+func AppURL(path string) string {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		base = "http://localhost:5173"
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
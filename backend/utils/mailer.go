@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// LoadMailer selects the mailer from MAILER: "smtp" sends through
+// SMTP_HOST, "file" writes each message to a file in MAIL_DIR and "log"
+// only notes that a message was sent, for development. MAILER is required so
+// a deployment cannot end up not sending mail by accident.
+func LoadMailer() (Mailer, error) {
+	switch mailer := os.Getenv("MAILER"); mailer {
+	case "":
+		return nil, fmt.Errorf("MAILER is required (smtp or file, or log when APP_ENV=development)")
+	case "log":
+		if !IsDevelopment() {
+			return nil, fmt.Errorf("MAILER=log is only allowed when APP_ENV=development")
+		}
+		return &LogMailer{}, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		return &FileMailer{Dir: dir}, nil
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required when MAILER=smtp")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		from := os.Getenv("MAIL_FROM")
+		if from == "" {
+			return nil, fmt.Errorf("MAIL_FROM is required when MAILER=smtp")
+		}
+		return &SMTPMailer{
+			Addr:     net.JoinHostPort(host, port),
+			Host:     host,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", mailer)
+	}
+}
+
+// SMTPMailer sends emails through an SMTP server, using STARTTLS when the
+// server offers it
+type SMTPMailer struct {
+	Addr     string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers the message through the SMTP server
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, formatMessage(m.From, to, subject, body))
+}
+
+// FileMailer writes each email to its own file in Dir
+type FileMailer struct {
+	Dir string
+}
+
+// Send writes the message to a new .eml file
+func (m *FileMailer) Send(to, subject, body string) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitizeFilename(to))
+	return os.WriteFile(filepath.Join(m.Dir, name), formatMessage("noreply@localhost", to, subject, body), 0o600)
+}
+
+// LogMailer logs that an email would have been sent instead of sending it.
+// The body is not logged: it holds one-time tokens, and anyone who can read
+// the log could use them. Use FileMailer to read messages in development.
+type LogMailer struct{}
+
+// Send logs the recipient and subject
+func (m *LogMailer) Send(to, subject, body string) error {
+	log.Printf("Mail to %s: %s (body not logged)", to, subject)
+	return nil
+}
+
+// formatMessage builds an RFC 5322 message with CRLF line endings
+func formatMessage(from, to, subject, body string) []byte {
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	body = strings.ReplaceAll(body, "\n", "\r\n")
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + body)
+}
+
+// sanitizeFilename keeps only characters that are safe in a file name
+func sanitizeFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '@' {
+			return r
+		}
+		return '_'
+	}, s)
+}
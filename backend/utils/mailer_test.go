@@ -0,0 +1,27 @@
+package utils
+
+import "testing"
+
+func TestLoadMailer(t *testing.T) {
+	tests := []struct {
+		mailer, appEnv string
+		wantErr        bool
+	}{
+		{"", "development", true},
+		{"", "", true},
+		{"log", "development", false},
+		{"log", "", true},
+		{"log", "production", true},
+		{"file", "", false},
+		{"smtp", "", true},
+		{"carrier-pigeon", "development", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAILER", tt.mailer)
+		t.Setenv("APP_ENV", tt.appEnv)
+		t.Setenv("SMTP_HOST", "")
+		if _, err := LoadMailer(); (err != nil) != tt.wantErr {
+			t.Errorf("MAILER=%q APP_ENV=%q: error %v, want error %v", tt.mailer, tt.appEnv, err, tt.wantErr)
+		}
+	}
+}
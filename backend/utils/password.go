@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+)
+
+//go:embed breached_passwords.txt
+var bundledBreachedPasswords string
+
+// PasswordPolicy describes the requirements for new passwords
+type PasswordPolicy struct {
+	MinLength      int
+	MaxLength      int
+	MinCharClasses int // of lowercase, uppercase, digits and symbols
+	Breached       *BreachedPasswords
+}
+
+// LoadPasswordPolicy reads the policy from PASSWORD_MIN_LENGTH (8),
+// PASSWORD_MAX_LENGTH (72, the most bcrypt uses) and
+// PASSWORD_MIN_CHAR_CLASSES (2). The breached password list is the bundled
+// one unless BREACHED_PASSWORDS_FILE points to another.
+func LoadPasswordPolicy() *PasswordPolicy {
+	policy := &PasswordPolicy{
+		MinLength:      GetEnvInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:      GetEnvInt("PASSWORD_MAX_LENGTH", 72),
+		MinCharClasses: GetEnvInt("PASSWORD_MIN_CHAR_CLASSES", 2),
+	}
+
+	var err error
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		policy.Breached, err = LoadBreachedPasswordsFile(path)
+		if err != nil {
+			log.Printf("Warning: failed to load %s, using the bundled list: %v", path, err)
+		}
+	}
+	if policy.Breached == nil {
+		policy.Breached, err = ParseBreachedPasswords(strings.NewReader(bundledBreachedPasswords))
+		if err != nil {
+			log.Printf("Warning: failed to parse the bundled breached password list: %v", err)
+		}
+	}
+	return policy
+}
+
+// Validate returns the reasons the password does not meet the policy, or
+// nil if it does. Personal values such as the username and email address
+// must not appear in the password.
+func (p *PasswordPolicy) Validate(password string, personal ...string) []string {
+	var problems []string
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes long", p.MaxLength))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	if classes < p.MinCharClasses {
+		problems = append(problems, fmt.Sprintf("must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", p.MinCharClasses))
+	}
+
+	lowered := strings.ToLower(password)
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		// Check the local part of email addresses as well
+		candidates := []string{value}
+		if at := strings.Index(value, "@"); at > 0 {
+			candidates = append(candidates, value[:at])
+		}
+		for _, candidate := range candidates {
+			if len(candidate) >= 3 && strings.Contains(lowered, candidate) {
+				problems = append(problems, "must not contain your username or email address")
+				break
+			}
+		}
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		problems = append(problems, "has appeared in a data breach or is too common, please choose another")
+	}
+	return dedupe(problems)
+}
+
+// dedupe removes repeated messages while keeping their order
+func dedupe(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	var result []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// BreachedPasswords is an offline set of SHA-1 password hashes grouped by
+// their first five hex characters, mirroring the k-anonymity range lookups of
+// the Pwned Passwords API
+type BreachedPasswords struct {
+	ranges map[string]map[string]bool
+}
+
+// LoadBreachedPasswordsFile reads a hash list from a file
+func LoadBreachedPasswordsFile(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseBreachedPasswords(f)
+}
+
+// ParseBreachedPasswords reads one uppercase or lowercase SHA-1 hex hash per
+// line, optionally followed by ":<count>" as in Pwned Passwords exports.
+// Blank lines and lines starting with # are ignored.
+func ParseBreachedPasswords(r io.Reader) (*BreachedPasswords, error) {
+	b := &BreachedPasswords{ranges: make(map[string]map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if len(line) != 2*sha1.Size {
+			return nil, fmt.Errorf("invalid SHA-1 hash %q", line)
+		}
+		line = strings.ToUpper(line)
+		prefix, suffix := line[:5], line[5:]
+		if b.ranges[prefix] == nil {
+			b.ranges[prefix] = make(map[string]bool)
+		}
+		b.ranges[prefix][suffix] = true
+	}
+	return b, scanner.Err()
+}
+
+// Contains reports whether the password is in the list
+func (b *BreachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	return b.ranges[hash[:5]][hash[5:]]
+}
@@ -0,0 +1,20 @@
+package utils
+
+// Roles a dashboard user can have. Every user has exactly one role.
+const (
+	RolePlayer    = "player"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permissions granted to roles through the role_permissions table
+const (
+	PermissionManageLockouts = "lockouts:manage"
+	PermissionManageRoles    = "roles:manage"
+	PermissionVoidScores     = "scores:void"
+	PermissionBanAccounts    = "accounts:ban"
+	PermissionReadUsers      = "users:read"
+	PermissionManageUsers    = "users:manage"
+	PermissionReadAuditLog   = "audit:read"
+	PermissionReadSecurity   = "security:read"
+)
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encryptedPrefix marks values produced by SecretBox.Encrypt. Stored values
+// without it are legacy plaintext.
+const encryptedPrefix = "enc:v1:"
+
+// SecretBox encrypts small secrets (such as TOTP seeds) with AES-256-GCM.
+// Each ciphertext is stored together with the ID of the key that produced it,
+// so old keys can stay configured for decryption while new values use the
+// current key.
+type SecretBox struct {
+	keys      map[string]cipher.AEAD
+	currentID string
+}
+
+// LoadSecretBox reads the keys from TOTP_ENCRYPTION_KEYS, a comma-separated
+// list of "<key id>:<base64 32-byte key>" pairs, and the key used for new
+// values from TOTP_ENCRYPTION_KEY_ID (defaults to the first key)
+func LoadSecretBox() (*SecretBox, error) {
+	raw := os.Getenv("TOTP_ENCRYPTION_KEYS")
+	if raw == "" {
+		return nil, fmt.Errorf("TOTP_ENCRYPTION_KEYS is not set")
+	}
+
+	box := &SecretBox{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range strings.Split(raw, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid TOTP_ENCRYPTION_KEYS entry, expected <key id>:<base64 key>")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("TOTP encryption key %q must be 32 bytes, base64 encoded", parts[0])
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		box.keys[parts[0]] = gcm
+		if box.currentID == "" {
+			box.currentID = parts[0]
+		}
+	}
+
+	if id := os.Getenv("TOTP_ENCRYPTION_KEY_ID"); id != "" {
+		if _, ok := box.keys[id]; !ok {
+			return nil, fmt.Errorf("TOTP_ENCRYPTION_KEY_ID %q is not in TOTP_ENCRYPTION_KEYS", id)
+		}
+		box.currentID = id
+	}
+	return box, nil
+}
+
+// Encrypt encrypts plaintext with the current key. associatedData binds the
+// ciphertext to its owner (e.g. the user ID) so it cannot be copied to
+// another row.
+func (b *SecretBox) Encrypt(plaintext, associatedData string) (string, error) {
+	gcm := b.keys[b.currentID]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(associatedData))
+	return encryptedPrefix + b.currentID + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value produced by Encrypt. Legacy plaintext values are
+// returned unchanged.
+func (b *SecretBox) Decrypt(value, associatedData string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	gcm, ok := b.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown encryption key %q", parts[0])
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(associatedData))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// NeedsReencrypt reports whether a stored value is plaintext or was
+// encrypted with a key other than the current one
+func (b *SecretBox) NeedsReencrypt(value string) bool {
+	return !strings.HasPrefix(value, encryptedPrefix+b.currentID+":")
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// TOTPConfig configures TOTP secret generation and code validation
+type TOTPConfig struct {
+	Issuer string
+	Period uint // seconds per time-step
+	Skew   uint // number of time-steps accepted before and after the current one
+	Digits otp.Digits
+	// Now is the clock used for validation; tests can replace it
+	Now func() time.Time
+}
+
+// maxTOTPSkew is the largest accepted TOTP_SKEW
+const maxTOTPSkew = 10
+
+// LoadTOTPConfig reads TOTP_PERIOD (at least one second) and TOTP_SKEW (0 to
+// maxTOTPSkew time-steps) from the environment
+func LoadTOTPConfig() (*TOTPConfig, error) {
+	period := GetEnvInt("TOTP_PERIOD", 30)
+	if period < 1 {
+		return nil, fmt.Errorf("TOTP_PERIOD must be at least 1 second, got %d", period)
+	}
+	skew := GetEnvInt("TOTP_SKEW", 1)
+	if skew < 0 || skew > maxTOTPSkew {
+		return nil, fmt.Errorf("TOTP_SKEW must be between 0 and %d, got %d", maxTOTPSkew, skew)
+	}
+	return &TOTPConfig{
+		Issuer: "WIRA Dashboard",
+		Period: uint(period),
+		Skew:   uint(skew),
+		Digits: otp.DigitsSix,
+		Now:    time.Now,
+	}, nil
+}
+
+// GenerateSecret generates a new TOTP secret and its otpauth URL, labelled
+// with the given account name in authenticator apps
+func (cfg *TOTPConfig) GenerateSecret(accountName string) (string, string, error) {
+	// Generate random bytes for the secret
+	bytes := make([]byte, 20)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err := cfg.generateKey(accountName, bytes)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key.Secret(), key.URL(), nil
+}
+
+// KeyURL rebuilds the otpauth URL for an existing base32 secret
+func (cfg *TOTPConfig) KeyURL(secret, accountName string) (string, error) {
+	bytes, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	key, err := cfg.generateKey(accountName, bytes)
+	if err != nil {
+		return "", err
+	}
+	return key.URL(), nil
+}
+
+// generateKey builds the TOTP key for the secret bytes
+func (cfg *TOTPConfig) generateKey(accountName string, secret []byte) (*otp.Key, error) {
+	return totp.Generate(totp.GenerateOpts{
+		Issuer:      cfg.Issuer,
+		AccountName: accountName,
+		Secret:      secret,
+		SecretSize:  uint(len(secret)),
+		Period:      cfg.Period,
+		Digits:      cfg.Digits,
+	})
+}
+
+// ValidateCode validates a TOTP code within the configured skew. Codes for
+// time-steps starting at or before lastUsed (Unix seconds) are rejected so a
+// code cannot be replayed. It returns the start of the matched time-step,
+// which the caller must store as the new lastUsed. Being a time rather than a
+// step number, it stays comparable when the period changes.
+func (cfg *TOTPConfig) ValidateCode(secret, code string, lastUsed int64) (int64, bool) {
+	opts := totp.ValidateOpts{
+		Period:    cfg.Period,
+		Digits:    cfg.Digits,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	now := cfg.Now()
+	period := int64(cfg.Period)
+	currentStep := now.Unix() / period
+
+	for offset := -int64(cfg.Skew); offset <= int64(cfg.Skew); offset++ {
+		stepStart := (currentStep + offset) * period
+		if stepStart <= lastUsed {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(stepStart, 0), opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return stepStart, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPSecretAAD is the associated data binding an encrypted TOTP secret to
+// its user
+func TOTPSecretAAD(userID int) string {
+	return fmt.Sprintf("users.two_factor_secret:%d", userID)
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// rfc6238Secret is the SHA-1 test secret from RFC 6238 appendix B
+// ("12345678901234567890" in base32)
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// testTOTPConfig returns a config whose clock is fixed at now
+func testTOTPConfig(period, skew uint, now time.Time) *TOTPConfig {
+	return &TOTPConfig{
+		Issuer: "WIRA Dashboard",
+		Period: period,
+		Skew:   skew,
+		Digits: otp.DigitsSix,
+		Now:    func() time.Time { return now },
+	}
+}
+
+// totpCodeAt generates the code for the time-step containing t
+func totpCodeAt(t *testing.T, secret string, period uint, at time.Time) string {
+	t.Helper()
+	code, err := totp.GenerateCodeCustom(secret, at, totp.ValidateOpts{
+		Period:    period,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTOTPConfigValidateCode(t *testing.T) {
+	// RFC 6238 vectors, truncated to six digits: 081804 is the code for step
+	// 37037036 (T=1111111109) and 050471 for step 37037037 (T=1111111111)
+	now := time.Unix(1111111111, 0)
+	const (
+		previousStep = 37037036 * 30 // start of the step, in Unix seconds
+		currentStep  = 37037037 * 30
+	)
+
+	tests := []struct {
+		name     string
+		skew     uint
+		now      time.Time
+		code     string
+		lastUsed int64
+		wantUsed int64
+		wantOK   bool
+	}{
+		{"current step", 1, now, "050471", 0, currentStep, true},
+		{"previous step within skew", 1, now, "081804", 0, previousStep, true},
+		{"next step within skew", 1, now.Add(-30 * time.Second), "050471", 0, currentStep, true},
+		{"previous step without skew", 0, now, "081804", 0, 0, false},
+		{"next step without skew", 0, now.Add(-30 * time.Second), "050471", 0, 0, false},
+		{"outside skew", 1, now.Add(60 * time.Second), "081804", 0, 0, false},
+		{"wider skew", 2, now.Add(30 * time.Second), "081804", 0, previousStep, true},
+		{"wrong code", 1, now, "123456", 0, 0, false},
+		{"replayed step", 1, now, "050471", currentStep, 0, false},
+		{"earlier step than last used", 1, now, "081804", currentStep, 0, false},
+		{"same step as last used", 1, now, "081804", previousStep, 0, false},
+		{"later step than last used", 1, now, "050471", previousStep, currentStep, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testTOTPConfig(30, tt.skew, tt.now)
+			used, ok := cfg.ValidateCode(rfc6238Secret, tt.code, tt.lastUsed)
+			if used != tt.wantUsed || ok != tt.wantOK {
+				t.Errorf("ValidateCode(%q, %d) = %d, %v, want %d, %v",
+					tt.code, tt.lastUsed, used, ok, tt.wantUsed, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTOTPConfigValidateCodeReplay(t *testing.T) {
+	// Storing the returned time as two_factor_last_used stops the same code
+	// being accepted again, even later within the skew window
+	now := time.Unix(1111111111, 0)
+	cfg := testTOTPConfig(30, 1, now)
+
+	used, ok := cfg.ValidateCode(rfc6238Secret, "050471", 0)
+	if !ok {
+		t.Fatal("first use rejected")
+	}
+	if _, ok := cfg.ValidateCode(rfc6238Secret, "050471", used); ok {
+		t.Error("replayed code accepted")
+	}
+
+	cfg.Now = func() time.Time { return now.Add(30 * time.Second) }
+	if _, ok := cfg.ValidateCode(rfc6238Secret, "050471", used); ok {
+		t.Error("replayed code accepted in the next step")
+	}
+	if _, ok := cfg.ValidateCode(rfc6238Secret, totpCodeAt(t, rfc6238Secret, 30, now.Add(30*time.Second)), used); !ok {
+		t.Error("code for the next step rejected")
+	}
+}
+
+func TestTOTPConfigValidateCodeAfterPeriodChange(t *testing.T) {
+	// A code accepted with a 30-second period must not make every code look
+	// like a replay once the period is 60 seconds
+	now := time.Unix(1111111111, 0)
+	used, ok := testTOTPConfig(30, 1, now).ValidateCode(rfc6238Secret, "050471", 0)
+	if !ok {
+		t.Fatal("code rejected with the old period")
+	}
+
+	later := now.Add(time.Minute)
+	cfg := testTOTPConfig(60, 1, later)
+	if _, ok := cfg.ValidateCode(rfc6238Secret, totpCodeAt(t, rfc6238Secret, 60, later), used); !ok {
+		t.Error("fresh code rejected after the period changed")
+	}
+}
+
+func TestTOTPConfigValidateCodePeriod(t *testing.T) {
+	const period = 60
+	now := time.Unix(1111111111, 0)
+	currentStep := now.Unix() / period
+
+	tests := []struct {
+		name     string
+		codeAt   time.Time
+		codeFor  uint // period the code was generated with
+		wantUsed int64
+		wantOK   bool
+	}{
+		{"current step", now, period, currentStep * period, true},
+		{"previous step within skew", now.Add(-period * time.Second), period, (currentStep - 1) * period, true},
+		{"two steps back", now.Add(-2 * period * time.Second), period, 0, false},
+		{"code for the default period", now.Add(-45 * time.Second), 30, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testTOTPConfig(period, 1, now)
+			code := totpCodeAt(t, rfc6238Secret, tt.codeFor, tt.codeAt)
+			used, ok := cfg.ValidateCode(rfc6238Secret, code, 0)
+			if used != tt.wantUsed || ok != tt.wantOK {
+				t.Errorf("ValidateCode(%q) = %d, %v, want %d, %v", code, used, ok, tt.wantUsed, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestLoadTOTPConfig(t *testing.T) {
+	tests := []struct {
+		period, skew string
+		wantErr      bool
+	}{
+		{"", "", false},
+		{"60", "2", false},
+		{"1", "0", false},
+		{"0", "1", true},
+		{"-30", "1", true},
+		{"30", "-1", true},
+		{"30", "11", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("TOTP_PERIOD", tt.period)
+		t.Setenv("TOTP_SKEW", tt.skew)
+		if _, err := LoadTOTPConfig(); (err != nil) != tt.wantErr {
+			t.Errorf("TOTP_PERIOD=%q TOTP_SKEW=%q: error %v, want error %v", tt.period, tt.skew, err, tt.wantErr)
+		}
+	}
+}
@@ -11,6 +11,9 @@ CREATE TABLE accounts (
     password VARCHAR(255) NOT NULL,
     two_factor_secret VARCHAR(32),
     two_factor_enabled BOOLEAN DEFAULT FALSE,
+    banned_at TIMESTAMP WITH TIME ZONE,
+    banned_until TIMESTAMP WITH TIME ZONE, -- NULL with banned_at set is a permanent ban
+    ban_reason TEXT,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
@@ -27,6 +30,8 @@ CREATE TABLE scores (
     score_id SERIAL PRIMARY KEY,
     char_id INTEGER REFERENCES characters(char_id),
     reward_score INTEGER NOT NULL DEFAULT 0,
+    voided_at TIMESTAMP WITH TIME ZONE,
+    void_reason TEXT,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -0,0 +1,78 @@
+import { reactive } from 'vue';
+import axios from 'axios';
+
+// State of the re-authentication prompt, rendered by ReauthDialog
+export const reauthState = reactive({
+  open: false,
+  resolve: null,
+  reject: null
+});
+
+// Opens the re-authentication prompt. Resolves once the user has
+// re-authenticated and rejects if they cancel.
+export function requestReauth() {
+  return new Promise((resolve, reject) => {
+    reauthState.resolve = resolve;
+    reauthState.reject = reject;
+    reauthState.open = true;
+  });
+}
+
+// Runs requestFn and, if the server asks for a recent re-authentication,
+// prompts for it and runs requestFn once more
+export async function withReauth(requestFn) {
+  try {
+    return await requestFn();
+  } catch (error) {
+    if (error.response?.status !== 403 || !error.response.data?.reauth_required) {
+      throw error;
+    }
+    await requestReauth();
+    return requestFn();
+  }
+}
+
+const fromBase64url = (value) => {
+  const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+  const padded = base64 + '='.repeat((4 - (base64.length % 4)) % 4);
+  return Uint8Array.from(window.atob(padded), (c) => c.charCodeAt(0)).buffer;
+};
+
+const toBase64url = (buffer) => {
+  const bytes = new Uint8Array(buffer);
+  let binary = '';
+  bytes.forEach((b) => { binary += String.fromCharCode(b); });
+  return window.btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+};
+
+// Re-authenticates with the password and a security key assertion
+export async function reauthWithSecurityKey(password) {
+  const begin = await axios.post('/api/auth/reauthenticate/webauthn/begin', { password });
+  const publicKey = begin.data.options.publicKey;
+
+  const credential = await navigator.credentials.get({
+    publicKey: {
+      ...publicKey,
+      challenge: fromBase64url(publicKey.challenge),
+      allowCredentials: (publicKey.allowCredentials || []).map((c) => ({
+        ...c,
+        id: fromBase64url(c.id)
+      }))
+    }
+  });
+
+  await axios.post(
+    `/api/auth/reauthenticate/webauthn/finish?session_id=${encodeURIComponent(begin.data.session_id)}`,
+    {
+      id: credential.id,
+      rawId: toBase64url(credential.rawId),
+      type: credential.type,
+      response: {
+        authenticatorData: toBase64url(credential.response.authenticatorData),
+        clientDataJSON: toBase64url(credential.response.clientDataJSON),
+        signature: toBase64url(credential.response.signature),
+        userHandle: credential.response.userHandle ? toBase64url(credential.response.userHandle) : null
+      }
+    }
+  );
+}